@@ -7,21 +7,107 @@ import (
 	"strings"
 )
 
+// Answers of the interactive mode, they work like the ones of
+// git add --patch.
+const (
+	AnswerYes        = "y"
+	AnswerNo         = "n"
+	AnswerAll        = "a"
+	AnswerQuit       = "q"
+	AnswerSkipRest   = "s"
+	AnswerAcceptFile = "A"
+	AnswerSkipFile   = "S"
+	AnswerEdit       = "e"
+)
+
+var replaceAnswers = []string{
+	AnswerYes, AnswerNo, AnswerAll, AnswerQuit,
+	AnswerSkipRest, AnswerAcceptFile, AnswerSkipFile, AnswerEdit,
+}
+
+var renameAnswers = []string{AnswerYes, AnswerNo, AnswerAll, AnswerQuit}
+
+var answerHelp = map[string]string{
+	AnswerYes:        "yes (default)",
+	AnswerNo:         "no",
+	AnswerAll:        "yes to this and all remaining questions",
+	AnswerQuit:       "quit, keep the changes accepted so far",
+	AnswerSkipRest:   "no to this and all remaining matches in this file",
+	AnswerAcceptFile: "yes to this and all remaining matches in this file",
+	AnswerSkipFile:   "no to all matches in this file, including the accepted ones",
+	AnswerEdit:       "edit the replacement",
+}
+
 type Ask struct {
-	Stdin  io.Reader
 	Stdout io.Writer
+	// Echo prints the replies, if they are not typed by the user
+	Echo bool
+
+	// reader is kept for all questions, so no buffered reply is lost
+	reader *bufio.Reader
+}
+
+func NewAsk(stdin io.Reader, stdout io.Writer) *Ask {
+	return &Ask{
+		Stdout: stdout,
+		reader: bufio.NewReader(stdin),
+	}
+}
+
+// question asks until one of the answers is given, an empty reply is yes and
+// the end of the input is quit.
+func (a *Ask) question(question string, answers []string) string {
+	for {
+		fmt.Fprintf(a.Stdout, "%s [%s,?]: ", question, strings.Join(answers, ","))
+		reply, ok := a.readLine()
+		if !ok {
+			return AnswerQuit
+		}
+		reply = strings.TrimSpace(reply)
+		switch reply {
+		case "":
+			reply = AnswerYes
+		case "Y", "N":
+			reply = strings.ToLower(reply)
+		}
+		for _, answer := range answers {
+			if reply == answer {
+				return answer
+			}
+		}
+		a.help(answers)
+	}
+}
+
+// edit asks for a new replacement, an empty reply keeps it.
+func (a *Ask) edit(replacement string) string {
+	fmt.Fprintf(a.Stdout, "Replacement [%s]: ", replacement)
+	reply, _ := a.readLine()
+	reply = strings.TrimRight(reply, "\r\n")
+	if reply == "" {
+		return replacement
+	}
+	return reply
+}
+
+func (a *Ask) help(answers []string) {
+	for _, answer := range answers {
+		fmt.Fprintf(a.Stdout, "%s - %s\n", answer, answerHelp[answer])
+	}
+	fmt.Fprintf(a.Stdout, "? - print help\n")
 }
 
-func (a Ask) question(question string) bool {
-	fmt.Fprintf(a.Stdout, "%s [Yn]: ", question)
-	reader := bufio.NewReader(a.Stdin)
-	reply, err := reader.ReadString('\n')
-	if err != nil {
-		panic(err)
+// readLine returns the next reply, it is not ok at the end of the input.
+func (a *Ask) readLine() (string, bool) {
+	reply, err := a.reader.ReadString('\n')
+	if err != nil && reply == "" {
+		if a.Echo {
+			fmt.Fprintln(a.Stdout)
+		}
+		return "", false
 	}
-	reply = strings.ToLower(strings.TrimSpace(reply))
-	if reply == "y" || reply == "" {
-		return true
+	if a.Echo {
+		fmt.Fprintln(a.Stdout, strings.TrimRight(reply, "\r\n"))
 	}
-	return false
+	return reply, true
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// BinaryCheckSize is the number of bytes checked by isBinary (like git).
+const BinaryCheckSize = 8000
+
+// isBinary reports whether the content looks binary, that is the first
+// block contains a NUL byte or is not valid UTF-8.
+func isBinary(content []byte) bool {
+	block := checkBlock(content)
+	truncated := len(block) < len(content)
+	if bytes.IndexByte(block, 0) >= 0 {
+		return true
+	}
+	if utf8.Valid(block) {
+		return false
+	}
+	// the last character may be cut off by the end of the block
+	for i := 1; truncated && i < utf8.UTFMax && i < len(block); i++ {
+		if utf8.Valid(block[:len(block)-i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBlock returns the first block of the content, which is checked by
+// isBinary and the detection of the encoding.
+func checkBlock(content []byte) []byte {
+	if len(content) > BinaryCheckSize {
+		return content[:BinaryCheckSize]
+	}
+	return content
+}
+
+// hasControlCharacters reports whether the block contains control
+// characters, which are not found in text files (NUL, BEL, ESC...).
+func hasControlCharacters(block []byte) bool {
+	for _, c := range block {
+		switch {
+		case c == '\t', c == '\n', c == '\r', c == '\f':
+		case c < 0x20, c == 0x7F:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsBinary(t *testing.T) {
+	cases := []struct {
+		content string
+		want    bool
+	}{
+		{"", false},
+		{"foo\nbar\n", false},
+		{"café", false},
+		{"foo\x00bar", true},
+		{"caf\xe9", true},
+		{"\x89PNG\r\n\x1a\n", true},
+		// multi byte character cut off at the end of the checked block
+		{strings.Repeat("a", BinaryCheckSize-1) + "é", false},
+		// NUL byte after the checked block
+		{strings.Repeat("a", BinaryCheckSize) + "\x00", false},
+	}
+	for index, c := range cases {
+		got := isBinary([]byte(c.content))
+		if got != c.want {
+			t.Errorf("Case: #%d - isBinary(%.20q) == %v, want %v", index, c.content, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// caseStyles render lower case words in the naming conventions supported by
+// the preserve case mode, in the order of preference for ambiguous spellings.
+var caseStyles = []func(words []string) string{
+	// fooBar
+	func(words []string) string {
+		return words[0] + strings.Join(titleWords(words[1:]), "")
+	},
+	// FooBar
+	func(words []string) string {
+		return strings.Join(titleWords(words), "")
+	},
+	// foo_bar
+	func(words []string) string {
+		return strings.Join(words, "_")
+	},
+	// FOO_BAR
+	func(words []string) string {
+		return strings.ToUpper(strings.Join(words, "_"))
+	},
+	// foo-bar
+	func(words []string) string {
+		return strings.Join(words, "-")
+	},
+}
+
+// caseVariants maps the spelling of search in every supported naming
+// convention to the spelling of replace in the same convention. The search
+// string itself is always mapped to the unchanged replace string.
+func caseVariants(search, replace string) map[string]string {
+	variants := map[string]string{search: replace}
+
+	searchWords := splitWords(search)
+	replaceWords := splitWords(replace)
+	if len(searchWords) == 0 || len(replaceWords) == 0 {
+		return variants
+	}
+	for _, style := range caseStyles {
+		variant := style(searchWords)
+		if _, ok := variants[variant]; !ok {
+			variants[variant] = style(replaceWords)
+		}
+	}
+	return variants
+}
+
+// caseVariantsPattern returns a regular expression matching every variant,
+// longer variants are preferred.
+func caseVariantsPattern(variants map[string]string) string {
+	keys := []string{}
+	for variant := range variants {
+		keys = append(keys, variant)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for i, key := range keys {
+		keys[i] = regexp.QuoteMeta(key)
+	}
+	return strings.Join(keys, "|")
+}
+
+// splitWords splits camelCase, PascalCase, snake_case, kebab-case and space
+// separated strings into lower case words.
+func splitWords(s string) []string {
+	words := []string{}
+	word := []rune{}
+	runes := []rune(s)
+
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = []rune{}
+		}
+	}
+
+	for i, r := range runes {
+		if r == '_' || r == '-' || unicode.IsSpace(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			// fooBar, foo1Bar and the Server in HTTPServer
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+
+	return words
+}
+
+func titleWords(words []string) []string {
+	titled := make([]string, len(words))
+	for i, word := range words {
+		runes := []rune(word)
+		runes[0] = unicode.ToUpper(runes[0])
+		titled[i] = string(runes)
+	}
+	return titled
+}
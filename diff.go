@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DiffContextLineCount = 3
+
+// Patch collects content changes and renames of a run and renders them as
+// a unified diff, which can be applied with `git apply` or `patch -p1`.
+type Patch struct {
+	rootDirectory string
+	files         []string
+	contents      map[string]patchContent
+	renames       map[string]string
+}
+
+type patchContent struct {
+	old, new string
+	// binary contents (e.g. UTF-16) are written as git binary patch
+	binary bool
+}
+
+func NewPatch(rootDirectory string) *Patch {
+	return &Patch{
+		rootDirectory: rootDirectory,
+		contents:      map[string]patchContent{},
+		renames:       map[string]string{},
+	}
+}
+
+// addFile registers a file, so it is part of the patch when it is moved by
+// a rename of one of its parent directories.
+func (p *Patch) addFile(path string) {
+	p.files = append(p.files, p.shortenPath(path))
+}
+
+func (p *Patch) addChange(path, oldContent, newContent string, binary bool) {
+	p.contents[p.shortenPath(path)] = patchContent{oldContent, newContent, binary}
+}
+
+// addRename records the new base name of a file or directory, path is the
+// original path as returned by the finder.
+func (p *Patch) addRename(path, newName string) {
+	p.renames[p.shortenPath(path)] = newName
+}
+
+func (p *Patch) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+
+	files := append([]string{}, p.files...)
+	sort.Strings(files)
+	for _, path := range files {
+		newPath := p.finalPath(path)
+		content, changed := p.contents[path]
+		if !changed && newPath == path {
+			continue
+		}
+
+		fmt.Fprintf(&b, "diff --git a/%s b/%s\n", path, newPath)
+		if newPath != path {
+			fmt.Fprintf(&b, "rename from %s\nrename to %s\n", path, newPath)
+		}
+		if changed && content.binary {
+			writeBinaryPatch(&b, content.old, content.new)
+		} else if changed {
+			fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", path, newPath)
+			writeHunks(&b, splitLines(content.old), splitLines(content.new))
+		}
+	}
+
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
+
+// finalPath applies the renames of the path and all of its parent
+// directories.
+func (p *Patch) finalPath(path string) string {
+	parts := strings.Split(path, "/")
+	newParts := make([]string, len(parts))
+	for i := range parts {
+		newParts[i] = parts[i]
+		if newName, ok := p.renames[strings.Join(parts[:i+1], "/")]; ok {
+			newParts[i] = newName
+		}
+	}
+	return strings.Join(newParts, "/")
+}
+
+func (p *Patch) shortenPath(path string) string {
+	return filepath.ToSlash(strings.Replace(path, p.rootDirectory+"/", "", 1))
+}
+
+// splitLines splits content into lines, each line keeps its line feed.
+func splitLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// diffLines computes the shortest edit script between a and b (Myers).
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace keeps the diagonals -d..d of v before step d, which are the only
+	// ones the backtracking reads, so memory grows with D² instead of (n+m)·D
+	trace := [][]int{}
+
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace, d)
+			}
+		}
+	}
+	return nil
+}
+
+func backtrackDiff(a, b []string, trace [][]int, d int) []diffOp {
+	ops := []diffOp{}
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 {
+		x--
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+func writeHunks(w io.Writer, a, b []string) {
+	ops := diffLines(a, b)
+
+	for start := 0; start < len(ops); {
+		// find next change
+		for start < len(ops) && ops[start].kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			return
+		}
+
+		// extend hunk until there are more than 2*context unchanged lines
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*DiffContextLineCount {
+				break
+			}
+		}
+
+		from := start - DiffContextLineCount
+		if from < 0 {
+			from = 0
+		}
+		to := end + DiffContextLineCount
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		writeHunk(w, ops, from, to)
+		start = to
+	}
+}
+
+func writeHunk(w io.Writer, ops []diffOp, from, to int) {
+	oldStart, newStart := 1, 1
+	for _, op := range ops[:from] {
+		if op.kind != '+' {
+			oldStart++
+		}
+		if op.kind != '-' {
+			newStart++
+		}
+	}
+	oldCount, newCount := 0, 0
+	for _, op := range ops[from:to] {
+		if op.kind != '+' {
+			oldCount++
+		}
+		if op.kind != '-' {
+			newCount++
+		}
+	}
+	// an empty range starts at the line before
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+
+	fmt.Fprintf(w, "@@ -%s +%s @@\n",
+		hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+	for _, op := range ops[from:to] {
+		fmt.Fprintf(w, "%c%s", op.kind, op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			fmt.Fprint(w, "\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// writeBinaryPatch writes the new content and the old one (for reverse
+// application) as git binary patch, git requires the full index line for it.
+func writeBinaryPatch(w io.Writer, oldContent, newContent string) {
+	fmt.Fprintf(w, "index %s..%s\nGIT binary patch\n", blobHash(oldContent), blobHash(newContent))
+	for _, content := range []string{newContent, oldContent} {
+		var deflated bytes.Buffer
+		z := zlib.NewWriter(&deflated)
+		io.WriteString(z, content)
+		z.Close()
+
+		fmt.Fprintf(w, "literal %d\n", len(content))
+		data := deflated.Bytes()
+		for len(data) > 0 {
+			n := len(data)
+			if n > 52 {
+				n = 52
+			}
+			// the length of the line: A-Z for 1-26, a-z for 27-52 bytes
+			length := byte('A' + n - 1)
+			if n > 26 {
+				length = byte('a' + n - 27)
+			}
+			fmt.Fprintf(w, "%c%s\n", length, encodeBase85(data[:n]))
+			data = data[n:]
+		}
+		fmt.Fprint(w, "\n")
+	}
+}
+
+const base85Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
+	"abcdefghijklmnopqrstuvwxyz!#$%&()*+-;<=>?@^_`{|}~"
+
+// encodeBase85 encodes the data in the base85 variant of git, every 4 bytes
+// become 5 characters, the last group is padded with zeros.
+func encodeBase85(data []byte) string {
+	var result []byte
+	for i := 0; i < len(data); i += 4 {
+		var group uint32
+		for j := 0; j < 4; j++ {
+			group <<= 8
+			if i+j < len(data) {
+				group |= uint32(data[i+j])
+			}
+		}
+		var chars [5]byte
+		for j := 4; j >= 0; j-- {
+			chars[j] = base85Alphabet[group%85]
+			group /= 85
+		}
+		result = append(result, chars[:]...)
+	}
+	return string(result)
+}
+
+// blobHash returns the object id of the content in git.
+func blobHash(content string) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", len(content))
+	io.WriteString(hash, content)
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
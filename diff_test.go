@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	patch := NewPatch("/root")
+	patch.addFile("/root/dir/a.txt")
+	patch.addFile("/root/dir/b.txt")
+	patch.addFile("/root/c.txt")
+	patch.addChange("/root/dir/a.txt",
+		"1\n2\n3\n4\nfoo\n6\n7\n8\n9\n10\n11\n12\n13\nfoo",
+		"1\n2\n3\n4\nbar\n6\n7\n8\n9\n10\n11\n12\n13\nbar", false)
+	patch.addRename("/root/dir/a.txt", "x.txt")
+	patch.addRename("/root/dir", "sub")
+
+	var b bytes.Buffer
+	patch.WriteTo(&b)
+
+	expected := "diff --git a/dir/a.txt b/sub/x.txt\n" +
+		"rename from dir/a.txt\n" +
+		"rename to sub/x.txt\n" +
+		"--- a/dir/a.txt\n" +
+		"+++ b/sub/x.txt\n" +
+		"@@ -2,7 +2,7 @@\n" +
+		" 2\n 3\n 4\n-foo\n+bar\n 6\n 7\n 8\n" +
+		"@@ -11,4 +11,4 @@\n" +
+		" 11\n 12\n 13\n-foo\n\\ No newline at end of file\n+bar\n\\ No newline at end of file\n" +
+		"diff --git a/dir/b.txt b/sub/b.txt\n" +
+		"rename from dir/b.txt\n" +
+		"rename to sub/b.txt\n"
+	if b.String() != expected {
+		t.Errorf("\n  actual: %#v\nexpected: %#v\n", b.String(), expected)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		a, b    string
+		changes int
+	}{
+		{"", "", 0},
+		{"", "a", 1},
+		{"a", "", 1},
+		{"abc", "abc", 0},
+		{"abc", "axc", 2},
+		{"abcabba", "cbabac", 5},
+		{"xxxxabcxxxx", "abcxxxxabc", 7},
+	}
+	for index, c := range cases {
+		a, b := strings.Split(c.a, ""), strings.Split(c.b, "")
+		ops := diffLines(a, b)
+		changes, oldLines, newLines := 0, []string{}, []string{}
+		for _, op := range ops {
+			if op.kind != '+' {
+				oldLines = append(oldLines, op.line)
+			}
+			if op.kind != '-' {
+				newLines = append(newLines, op.line)
+			}
+			if op.kind != ' ' {
+				changes++
+			}
+		}
+		if strings.Join(oldLines, "") != c.a || strings.Join(newLines, "") != c.b || changes != c.changes {
+			t.Errorf("Case #%d - unexpected edit script: %v", index, ops)
+		}
+	}
+}
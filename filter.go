@@ -1,7 +1,6 @@
 package main
 
 import (
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -9,7 +8,7 @@ import (
 )
 
 type Filterer interface {
-	Filter(s string) bool
+	Filter(path string, isDir bool) bool
 }
 
 var directoryBlacklist = map[string]bool{
@@ -17,39 +16,70 @@ var directoryBlacklist = map[string]bool{
 	".hg":       true,
 	".svn":      true,
 	".DS_Store": true,
+
+	JournalDirectory: true,
 }
 
 type Filter struct {
 	rootDirectory string
-	gitIgnore     *ignore.GitIgnore
+	ignoreRules   *IgnoreRules
+	includes      *ignore.GitIgnore
+	excludes      *ignore.GitIgnore
 }
 
 func NewFilter(rootDirectory string) *Filter {
-	gitIgnore, err := ignore.CompileIgnoreLines()
-	if err != nil {
-		panic(err)
+	return &Filter{
+		rootDirectory: rootDirectory,
+		ignoreRules:   NewIgnoreRules(rootDirectory),
 	}
+}
 
-	ignoreFilePath := filepath.Join(rootDirectory, ".gitignore")
-	if fi, err := os.Stat(ignoreFilePath); err == nil && fi.IsDir() == false {
-		gitIgnore, err = ignore.CompileIgnoreFile(ignoreFilePath)
-		if err != nil {
-			panic(err)
-		}
+// SetOutput reports invalid ignore files to the output.
+func (f *Filter) SetOutput(output *Output) {
+	f.ignoreRules.output = output
+}
+
+// SetIncludes restricts the files to those matching at least one of the
+// gitignore style patterns, directories are not affected.
+func (f *Filter) SetIncludes(patterns []string) error {
+	if len(patterns) == 0 {
+		f.includes = nil
+		return nil
 	}
+	includes, err := ignore.CompileIgnoreLines(patterns...)
+	f.includes = includes
+	return err
+}
 
-	return &Filter{
-		rootDirectory: rootDirectory,
-		gitIgnore:     gitIgnore,
+// SetExcludes filters files and directories matching the gitignore style
+// patterns.
+func (f *Filter) SetExcludes(patterns []string) error {
+	if len(patterns) == 0 {
+		f.excludes = nil
+		return nil
 	}
+	excludes, err := ignore.CompileIgnoreLines(patterns...)
+	f.excludes = excludes
+	return err
 }
 
-func (f *Filter) Filter(path string) bool {
+func (f *Filter) Filter(path string, isDir bool) bool {
 	basename := filepath.Base(path)
 	if directoryBlacklist[basename] {
 		return true
 	}
-	if f.gitIgnore.MatchesPath(f.shortenPath(path)) {
+	if f.ignoreRules.Matches(path, isDir) {
+		return true
+	}
+	shortPath := f.shortenPath(path)
+	if isDir {
+		// let patterns with a trailing slash match the directory itself
+		shortPath += "/"
+	}
+	if f.excludes != nil && f.excludes.MatchesPath(shortPath) {
+		return true
+	}
+	if !isDir && f.includes != nil && !f.includes.MatchesPath(shortPath) {
 		return true
 	}
 	return false
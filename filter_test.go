@@ -1,26 +1,116 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestFilter(t *testing.T) {
 	cases := []struct {
-		in   string
-		want bool
+		in    string
+		isDir bool
+		want  bool
 	}{
-		{"t1", false},
-		{"p/t1", false},
-		{"p/.git/d", false},
+		{"t1", true, false},
+		{"p/t1", false, false},
+		{"p/.git/d", false, false},
 
-		{"p/.git", true},
-		{".git", true},
-		{".hg", true},
-		{".svn", true},
+		{"p/.git", true, true},
+		{".git", true, true},
+		{".hg", true, true},
+		{".svn", true, true},
 	}
 	for _, c := range cases {
 		filter := NewFilter("")
-		got := filter.Filter(c.in)
+		got := filter.Filter(c.in, c.isDir)
 		if got != c.want {
-			t.Errorf("Filter(%v) == %v, want %v", c.in, got, c.want)
+			t.Errorf("Filter(%v, %v) == %v, want %v", c.in, c.isDir, got, c.want)
+		}
+	}
+}
+
+func TestFilterIncludesAndExcludes(t *testing.T) {
+	cases := []struct {
+		in    string
+		isDir bool
+		want  bool
+	}{
+		{"main.go", false, false},
+		{"sub/main.go", false, false},
+		{"main.js", false, true},
+		{"sub", true, false},
+		{"vendor", true, true},
+		{"vendor/lib.go", false, true},
+		{"sub/main_test.go", false, true},
+	}
+	filter := NewFilter("/root")
+	filter.SetIncludes([]string{"*.go"})
+	filter.SetExcludes([]string{"vendor/**", "*_test.go"})
+	for _, c := range cases {
+		got := filter.Filter("/root/"+c.in, c.isDir)
+		if got != c.want {
+			t.Errorf("Filter(%v, %v) == %v, want %v", c.in, c.isDir, got, c.want)
+		}
+	}
+}
+
+func TestFilterIgnoreFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	setenv(t, "GIT_CONFIG_GLOBAL", "/dev/null")
+	setenv(t, "GIT_CONFIG_NOSYSTEM", "1")
+	setenv(t, "XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+
+	files := map[string]string{
+		"xdg/git/ignore":    "*.swp\n",
+		".git/info/exclude": "*.log\n",
+		".gitignore":        "build/\n*.tmp\n/top.txt\n",
+		"sub/.gitignore":    "!keep.tmp\nlocal.txt\n/anchored.txt\nlib/*.js\n",
+		"sub/.sarignore":    "generated.go\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		in    string
+		isDir bool
+		want  bool
+	}{
+		{"sub/main.go", false, false},
+		{"sub/x.swp", false, true},
+		{"sub/x.log", false, true},
+		{"sub/a.tmp", false, true},
+		{"sub/keep.tmp", false, false},
+		{"sub/local.txt", false, true},
+		{"sub/deep/local.txt", false, true},
+		{"other/local.txt", false, false},
+		{"sub/anchored.txt", false, true},
+		{"sub/deep/anchored.txt", false, false},
+		{"sub/lib/x.js", false, true},
+		{"sub/deep/lib/x.js", false, false},
+		{"sub/top.txt", false, false},
+		{"top.txt", false, true},
+		{"sub/build", true, true},
+		{"sub/build", false, false},
+		{"sub/generated.go", false, true},
+	}
+	// run from a subdirectory of the work tree
+	filter := NewFilter(filepath.Join(dir, "sub"))
+	for _, c := range cases {
+		got := filter.Filter(filepath.Join(dir, c.in), c.isDir)
+		if got != c.want {
+			t.Errorf("Filter(%v, %v) == %v, want %v", c.in, c.isDir, got, c.want)
 		}
 	}
 }
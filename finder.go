@@ -1,8 +1,10 @@
 package main
 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 type Finder struct {
@@ -10,28 +12,111 @@ type Finder struct {
 	filter Filterer
 }
 
-func (f *Finder) Find(searchDir string) []string {
-	fileList := []string{}
-	filepath.Walk(searchDir, func(path string, fi os.FileInfo, err error) error {
-		if path == searchDir {
+// Entry is a file or directory found by the finder, Err is set if the
+// path could not be read.
+type Entry struct {
+	Path  string
+	IsDir bool
+	Err   error
+}
+
+// Stream walks searchDir in lexical order and sends every entry, which is
+// not filtered, as soon as it is found. The channel is closed when the walk
+// is done.
+func (f *Finder) Stream(searchDir string) <-chan Entry {
+	entries := make(chan Entry, 64)
+	go func() {
+		defer close(entries)
+		f.walk(searchDir, func(entry Entry) {
+			entries <- entry
+		})
+	}()
+	return entries
+}
+
+// StreamPaths sends the given files and directories in lexical order, so
+// directories come before their content. Directories are walked like by
+// Stream, the root directory itself is not sent. Relative paths are
+// relative to the root directory and every path is sent only once.
+func (f *Finder) StreamPaths(rootDirectory string, paths []string) <-chan Entry {
+	sorted := []string{}
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(rootDirectory, path)
+		}
+		sorted = append(sorted, filepath.Clean(path))
+	}
+	sort.Strings(sorted)
+
+	entries := make(chan Entry, 64)
+	go func() {
+		defer close(entries)
+		sent := map[string]bool{}
+		send := func(entry Entry) {
+			if !sent[entry.Path] {
+				sent[entry.Path] = true
+				entries <- entry
+			}
+		}
+		for _, path := range sorted {
+			if sent[path] {
+				continue
+			}
+			fileInfo, err := os.Lstat(path)
+			if err != nil {
+				send(Entry{Path: path, Err: err})
+				continue
+			}
+			if fileInfo.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+			if path != filepath.Clean(rootDirectory) {
+				if f.filter.Filter(path, fileInfo.IsDir()) {
+					continue
+				}
+				send(Entry{Path: path, IsDir: fileInfo.IsDir()})
+			}
+			if fileInfo.IsDir() {
+				f.walk(path, send)
+			}
+		}
+	}()
+	return entries
+}
+
+// walk sends all entries below searchDir, which are not filtered.
+func (f *Finder) walk(searchDir string, send func(Entry)) {
+	filepath.WalkDir(searchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			send(Entry{Path: path, Err: err})
 			return nil
 		}
-		if fi == nil {
-			f.output.reportError("Could not read fileinfo: " + path)
+		if path == searchDir {
 			return nil
 		}
-		if f.filter.Filter(path) {
-			if fi.IsDir() {
+		if f.filter.Filter(path, d.IsDir()) {
+			if d.IsDir() {
 				return filepath.SkipDir
-			} else {
-				return nil
 			}
+			return nil
 		}
-		if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
-			return filepath.SkipDir
+		if d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			return nil
 		}
-		fileList = append(fileList, path)
+		send(Entry{Path: path, IsDir: d.IsDir()})
 		return nil
 	})
+}
+
+// Find returns the paths of all entries.
+func (f *Finder) Find(searchDir string) []string {
+	fileList := []string{}
+	for entry := range f.Stream(searchDir) {
+		if entry.Err != nil {
+			f.output.reportError("Could not read: %s (%s)", entry.Path, entry.Err)
+			continue
+		}
+		fileList = append(fileList, entry.Path)
+	}
 	return fileList
 }
@@ -9,7 +9,7 @@ type FilterStub struct {
 	response bool
 }
 
-func (f FilterStub) Filter(path string) bool {
+func (f FilterStub) Filter(path string, isDir bool) bool {
 	return f.response
 }
 
@@ -46,3 +46,40 @@ func TestFind(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamPaths(t *testing.T) {
+	expected := []Entry{
+		{Path: "testdata/t2/foo.txt"},
+		{Path: "testdata/t2/missing"},
+		{Path: "testdata/t2/sub", IsDir: true},
+		{Path: "testdata/t2/sub/foo"},
+	}
+	actual := []Entry{}
+	finder := &Finder{filter: NewFilter("testdata/t2")}
+	paths := []string{"sub/foo", "missing", "sub", "foo.txt", "sub/../foo.txt"}
+	for entry := range finder.StreamPaths("testdata/t2", paths) {
+		if (entry.Err != nil) != (entry.Path == "testdata/t2/missing") {
+			t.Errorf("Unexpected error of %s: %v", entry.Path, entry.Err)
+		}
+		entry.Err = nil
+		actual = append(actual, entry)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("\n  actual: %#v\nexpected: %#v\n", actual, expected)
+	}
+}
+
+func TestStream(t *testing.T) {
+	expected := []Entry{
+		{Path: "testdata/t2/foo.txt"},
+		{Path: "testdata/t2/sub", IsDir: true},
+		{Path: "testdata/t2/sub/foo"},
+	}
+	actual := []Entry{}
+	for entry := range (&Finder{filter: NewFilter("testdata/t2")}).Stream("testdata/t2") {
+		actual = append(actual, entry)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("\n  actual: %#v\nexpected: %#v\n", actual, expected)
+	}
+}
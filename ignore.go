@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sabhiram/go-git-ignore"
+)
+
+// ignoreFileNames are read in every directory, the tool specific .sarignore
+// takes precedence over the .gitignore of the same directory.
+var ignoreFileNames = []string{".gitignore", ".sarignore"}
+
+// IgnoreRules applies the ignore files of a git work tree with the
+// precedence of git: the global excludes file (core.excludesFile), then
+// .git/info/exclude, then the ignore files from the top level directory
+// down to the directory of a path. Outside of a git work tree only the
+// ignore files below the root directory are used.
+type IgnoreRules struct {
+	baseDirectory    string
+	workingDirectory string
+	// excludesFiles are the global excludes file and .git/info/exclude
+	excludesFiles []string
+	dirs          map[string]*ignoreDir
+	// output reports invalid ignore files, they are skipped silently
+	// without it
+	output *Output
+}
+
+// ignoreDir holds the patterns of a directory including the patterns of
+// all parent directories, rewritten relative to the base directory.
+type ignoreDir struct {
+	lines   []string
+	matcher *ignore.GitIgnore
+}
+
+func NewIgnoreRules(rootDirectory string) *IgnoreRules {
+	workingDirectory, _ := os.Getwd()
+	baseDirectory := rootDirectory
+	if !filepath.IsAbs(baseDirectory) {
+		baseDirectory = filepath.Join(workingDirectory, baseDirectory)
+	}
+
+	r := &IgnoreRules{
+		baseDirectory:    baseDirectory,
+		workingDirectory: workingDirectory,
+		dirs:             map[string]*ignoreDir{},
+	}
+
+	if workTree, gitDir := findGitWorkTree(baseDirectory); workTree != "" {
+		r.baseDirectory = workTree
+		r.excludesFiles = []string{
+			globalExcludesFile(workTree),
+			filepath.Join(gitDir, "info", "exclude"),
+		}
+	}
+
+	return r
+}
+
+// Matches reports whether the path is ignored, relative paths are relative
+// to the current working directory.
+func (r *IgnoreRules) Matches(filePath string, isDir bool) bool {
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(r.workingDirectory, filePath)
+	}
+	relPath, err := filepath.Rel(r.baseDirectory, filePath)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return false
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	matcher := r.dir(path.Dir(relPath)).matcher
+	if isDir {
+		// let patterns with a trailing slash match the directory itself
+		relPath += "/"
+	}
+	return matcher.MatchesPath(relPath)
+}
+
+func (r *IgnoreRules) dir(dir string) *ignoreDir {
+	if d, ok := r.dirs[dir]; ok {
+		return d
+	}
+	var parentLines []string
+	if dir != "." {
+		parentLines = r.dir(path.Dir(dir)).lines
+	}
+	d := r.newIgnoreDir(parentLines, dir)
+	r.dirs[dir] = d
+	return d
+}
+
+func (r *IgnoreRules) newIgnoreDir(parentLines []string, dir string) *ignoreDir {
+	files := []string{}
+	if dir == "." {
+		files = append(files, r.excludesFiles...)
+	}
+	for _, name := range ignoreFileNames {
+		files = append(files, filepath.Join(r.baseDirectory, dir, name))
+	}
+	lines := []string{}
+	for _, file := range files {
+		lines = append(lines, r.readIgnoreFile(file, dir)...)
+	}
+	if len(lines) == 0 && dir != "." {
+		// share the patterns of the parent directory
+		return r.dirs[path.Dir(dir)]
+	}
+
+	lines = append(append([]string{}, parentLines...), lines...)
+	// every file compiled on its own already, so the lines compile
+	matcher, _ := ignore.CompileIgnoreLines(lines...)
+	return &ignoreDir{lines: lines, matcher: matcher}
+}
+
+// readIgnoreFile returns the patterns of an ignore file anchored to dir. A
+// file with an invalid pattern is reported and skipped as a whole, like a
+// file which can not be read.
+func (r *IgnoreRules) readIgnoreFile(file, dir string) []string {
+	lines := []string{}
+	for _, line := range readLines(file) {
+		lines = append(lines, anchorPattern(dir, line))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if _, err := ignore.CompileIgnoreLines(lines...); err != nil {
+		if r.output != nil {
+			if rel, relErr := filepath.Rel(r.workingDirectory, file); relErr == nil {
+				file = rel
+			}
+			r.output.reportWarning("Invalid ignore file: %s (%s), skipped", file, err)
+		}
+		return nil
+	}
+	return lines
+}
+
+// anchorPattern rewrites a pattern of an ignore file in dir, so it can be
+// matched against paths relative to the base directory.
+func anchorPattern(dir, line string) string {
+	pattern := strings.TrimSpace(strings.TrimRight(line, "\r"))
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ""
+	}
+
+	negate := ""
+	if strings.HasPrefix(pattern, "!") {
+		negate = "!"
+		pattern = pattern[1:]
+	}
+
+	prefix := "/"
+	if dir != "." {
+		prefix = "/" + dir + "/"
+	}
+	if strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+		// patterns containing a slash are relative to the directory
+		return negate + prefix + strings.TrimPrefix(pattern, "/")
+	}
+	if dir == "." {
+		return negate + pattern
+	}
+	// other patterns match in the directory and all of its subdirectories
+	return negate + prefix + "**/" + pattern
+}
+
+// findGitWorkTree returns the top level directory of the git work tree
+// containing dir and its git directory, or empty strings.
+func findGitWorkTree(dir string) (string, string) {
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		if fi, err := os.Stat(gitPath); err == nil {
+			if fi.IsDir() {
+				return dir, gitPath
+			}
+			// work trees and submodules contain a file: "gitdir: <path>"
+			for _, line := range readLines(gitPath) {
+				if strings.HasPrefix(line, "gitdir:") {
+					gitDir := strings.TrimSpace(strings.TrimPrefix(line, "gitdir:"))
+					if !filepath.IsAbs(gitDir) {
+						gitDir = filepath.Join(dir, gitDir)
+					}
+					return dir, gitDir
+				}
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ""
+		}
+		dir = parent
+	}
+}
+
+// globalExcludesFile returns the configured core.excludesFile or git's
+// default $XDG_CONFIG_HOME/git/ignore.
+func globalExcludesFile(workTree string) string {
+	cmd := exec.Command("git", "config", "--path", "--get", "core.excludesFile")
+	cmd.Dir = workTree
+	if out, err := cmd.Output(); err == nil && strings.TrimSpace(string(out)) != "" {
+		return strings.TrimSpace(string(out))
+	}
+	if xdgConfigHome := os.Getenv("XDG_CONFIG_HOME"); xdgConfigHome != "" {
+		return filepath.Join(xdgConfigHome, "git", "ignore")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "git", "ignore")
+	}
+	return ""
+}
+
+func readLines(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Split(string(data), "\n")
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalDirectory is created in the root directory, it contains the
+// journals of all runs and the backups of the files changed by them.
+const JournalDirectory = ".search-and-replace"
+
+const (
+	JournalWrite  = "write"
+	JournalRename = "rename"
+	// JournalRemove removes a directory, which was emptied by a merge
+	JournalRemove = "remove"
+	// JournalDone completes the write entry with the same backup, the entry
+	// is appended before the file is written
+	JournalDone = "done"
+)
+
+// JournalSyncInterval is the number of entries after which the journal file
+// is synced to disk, it is synced when it is closed too.
+const JournalSyncInterval = 1000
+
+var ErrNoJournal = errors.New("no journal found")
+
+// Journal records every write and rename of a run, so the run can be
+// undone. Paths are relative to the root directory.
+//
+// The journal file has one JSON record per line: the journal itself,
+// followed by its entries. An entry is appended as soon as it is made, so
+// the journal is complete even if a run is aborted.
+type Journal struct {
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Args    []string        `json:"args"`
+	Undone  bool            `json:"undone"`
+	Entries []*JournalEntry `json:"-"`
+
+	rootDirectory string
+	// the writes are recorded by concurrent workers
+	mutex    sync.Mutex
+	file     *os.File
+	unsynced int
+	backups  int
+}
+
+type JournalEntry struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// NewPath is the target of a rename
+	NewPath string `json:"newPath,omitempty"`
+	// OriginalHash and Hash are the sha256 of the content before and after
+	// a write, the original content is saved as Backup
+	OriginalHash string `json:"originalHash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Backup       string `json:"backup,omitempty"`
+	// Mode is the permission of a removed directory
+	Mode os.FileMode `json:"mode,omitempty"`
+	// Pending is set until the write is done, the file may still have its
+	// original content
+	Pending bool `json:"pending,omitempty"`
+}
+
+func NewJournal(rootDirectory string, args []string) *Journal {
+	now := time.Now()
+	return &Journal{
+		ID:            now.Format("20060102T150405.000000"),
+		Time:          now,
+		Args:          args,
+		Entries:       []*JournalEntry{},
+		rootDirectory: rootDirectory,
+	}
+}
+
+// LoadJournal loads the journal with the given id, or the latest journal
+// which was not undone yet if id is empty.
+func LoadJournal(rootDirectory, id string) (*Journal, error) {
+	journalDir := filepath.Join(rootDirectory, JournalDirectory, "journal")
+	if id != "" {
+		return loadJournalFile(rootDirectory, filepath.Join(journalDir, id+".jsonl"))
+	}
+
+	entries, err := ioutil.ReadDir(journalDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoJournal
+		}
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".jsonl") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		journal, err := loadJournalFile(rootDirectory, filepath.Join(journalDir, name))
+		if err != nil {
+			return nil, err
+		}
+		if !journal.Undone {
+			return journal, nil
+		}
+	}
+	return nil, ErrNoJournal
+}
+
+func loadJournalFile(rootDirectory, path string) (*Journal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoJournal
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	journal := &Journal{rootDirectory: rootDirectory}
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(journal); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	writes := map[string]*JournalEntry{}
+	for {
+		entry := &JournalEntry{}
+		if err := decoder.Decode(entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		switch entry.Type {
+		case JournalDone:
+			if write, ok := writes[entry.Backup]; ok {
+				write.Pending = false
+			}
+			continue
+		case JournalWrite:
+			writes[entry.Backup] = entry
+		}
+		journal.Entries = append(journal.Entries, entry)
+	}
+	return journal, nil
+}
+
+// recordWrite saves a backup of the original content of a file, which is
+// about to be written. The entry is pending until recordDone is called after
+// the write.
+func (j *Journal) recordWrite(path string, original, content []byte) (*JournalEntry, error) {
+	j.mutex.Lock()
+	j.backups++
+	backup := fmt.Sprintf("%d", j.backups)
+	j.mutex.Unlock()
+
+	backupPath := j.backupPath(backup)
+	if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(backupPath, original, 0600); err != nil {
+		return nil, err
+	}
+
+	entry := &JournalEntry{
+		Type:         JournalWrite,
+		Path:         j.relativePath(path),
+		OriginalHash: contentHash(original),
+		Hash:         contentHash(content),
+		Backup:       backup,
+		Pending:      true,
+	}
+	return entry, j.append(entry)
+}
+
+// recordDone marks the entry of a write as done.
+func (j *Journal) recordDone(entry *JournalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entry.Pending = false
+	return j.write(&JournalEntry{Type: JournalDone, Backup: entry.Backup})
+}
+
+// recordMove records a move of a rename, which is a rename or the removal
+// of a merged directory.
+func (j *Journal) recordMove(move renameMove) error {
+	entry := &JournalEntry{Type: JournalRemove, Path: j.relativePath(move.Path), Mode: move.Mode}
+	if move.NewPath != "" {
+		entry.Type = JournalRename
+		entry.NewPath = j.relativePath(move.NewPath)
+	}
+	return j.append(entry)
+}
+
+// append adds the entry and appends it to the journal file.
+func (j *Journal) append(entry *JournalEntry) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Entries = append(j.Entries, entry)
+	return j.write(entry)
+}
+
+// write appends a record to the journal file, which is created with the
+// first record.
+func (j *Journal) write(record interface{}) error {
+	if j.file == nil {
+		file, err := j.create(os.O_EXCL)
+		if err != nil {
+			return err
+		}
+		j.file = file
+	}
+	if err := writeRecord(j.file, record); err != nil {
+		return err
+	}
+	j.unsynced++
+	if j.unsynced < JournalSyncInterval {
+		return nil
+	}
+	j.unsynced = 0
+	return j.file.Sync()
+}
+
+// close syncs and closes the journal file, it does nothing if no entry was
+// recorded.
+func (j *Journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Sync()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
+
+// save writes the whole journal, e.g. after it was marked as undone.
+func (j *Journal) save() error {
+	file, err := j.create(os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	for _, entry := range j.Entries {
+		if err := writeRecord(file, entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// create creates the journal file with the given flag and writes the
+// journal record.
+func (j *Journal) create(flag int) (*os.File, error) {
+	dir := filepath.Join(j.rootDirectory, JournalDirectory)
+	if err := os.MkdirAll(filepath.Join(dir, "journal"), 0755); err != nil {
+		return nil, err
+	}
+	// keep the journal out of version control
+	gitIgnore := filepath.Join(dir, ".gitignore")
+	if _, err := os.Stat(gitIgnore); os.IsNotExist(err) {
+		ioutil.WriteFile(gitIgnore, []byte("*\n"), 0644)
+	}
+
+	file, err := os.OpenFile(j.path(), os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRecord(file, j); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func writeRecord(w io.Writer, record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (j *Journal) path() string {
+	return filepath.Join(j.rootDirectory, JournalDirectory, "journal", j.ID+".jsonl")
+}
+
+func (j *Journal) backupPath(backup string) string {
+	return filepath.Join(j.rootDirectory, JournalDirectory, "backup", j.ID, backup)
+}
+
+func (j *Journal) relativePath(path string) string {
+	if rel, err := filepath.Rel(j.rootDirectory, path); err == nil {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+func (j *Journal) absolutePath(path string) string {
+	return filepath.Join(j.rootDirectory, filepath.FromSlash(path))
+}
+
+// journalNode is a path of the tree, which is followed through the renames
+// of a run. A renamed node moves with the nodes inside of it.
+type journalNode struct {
+	name     string
+	parent   *journalNode
+	children map[string]*journalNode
+}
+
+func newJournalNode(name string, parent *journalNode) *journalNode {
+	return &journalNode{name: name, parent: parent, children: map[string]*journalNode{}}
+}
+
+// detach drops the node from the tree, a later lookup of its path returns a
+// new node.
+func (n *journalNode) detach() {
+	delete(n.parent.children, n.name)
+}
+
+// path returns the slash separated path of the node.
+func (n *journalNode) path() string {
+	names := []string{}
+	for ; n.parent != nil; n = n.parent {
+		names = append([]string{n.name}, names...)
+	}
+	return strings.Join(names, "/")
+}
+
+// currentPaths returns the nodes of the paths and new paths of the entries,
+// their paths are the current paths after all following renames of the run.
+func (j *Journal) currentPaths() ([]*journalNode, []*journalNode) {
+	root := newJournalNode("", nil)
+	lookup := func(p string) *journalNode {
+		node := root
+		if p == "." {
+			return node
+		}
+		for _, name := range strings.Split(p, "/") {
+			child, ok := node.children[name]
+			if !ok {
+				child = newJournalNode(name, node)
+				node.children[name] = child
+			}
+			node = child
+		}
+		return node
+	}
+
+	paths := make([]*journalNode, len(j.Entries))
+	newPaths := make([]*journalNode, len(j.Entries))
+	for index, entry := range j.Entries {
+		node := lookup(entry.Path)
+		switch entry.Type {
+		case JournalRename:
+			node.detach()
+			parent := lookup(path.Dir(entry.NewPath))
+			node.name, node.parent = path.Base(entry.NewPath), parent
+			parent.children[node.name] = node
+			newPaths[index] = node
+			node = lookup(entry.Path)
+		case JournalRemove:
+			node.detach()
+			node = lookup(entry.Path)
+		}
+		paths[index] = node
+	}
+	return paths, newPaths
+}
+
+// conflicts lists all changes of the tree since the run, which prevent the
+// run from being undone.
+func (j *Journal) conflicts() []string {
+	conflicts := []string{}
+	paths, newPaths := j.currentPaths()
+	for index, entry := range j.Entries {
+		path := paths[index].path()
+		switch entry.Type {
+		case JournalWrite:
+			content, err := ioutil.ReadFile(j.absolutePath(path))
+			if err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("Could not read: %s (%s)", path, err))
+			} else if hash := contentHash(content); hash != entry.Hash &&
+				!(entry.Pending && hash == entry.OriginalHash) {
+				conflicts = append(conflicts, fmt.Sprintf("Changed since the run: %s", path))
+			}
+		case JournalRename:
+			newPath := newPaths[index].path()
+			if _, err := os.Lstat(j.absolutePath(newPath)); err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("Missing: %s", newPath))
+			}
+			if _, err := os.Lstat(j.absolutePath(path)); err == nil {
+				conflicts = append(conflicts, fmt.Sprintf("Already exists: %s", path))
+			}
+		case JournalRemove:
+			if _, err := os.Lstat(j.absolutePath(path)); err == nil {
+				conflicts = append(conflicts, fmt.Sprintf("Already exists: %s", path))
+			}
+		}
+	}
+	return conflicts
+}
+
+func contentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
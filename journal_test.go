@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a large run, the journal is synced in between
+	journal := NewJournal(dir, []string{"foo", "bar"})
+	// the second write is not done
+	for _, name := range []string{"foo.txt", "foo2.txt"} {
+		entry, err := journal.recordWrite(filepath.Join(dir, name), []byte("foo"), []byte("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "foo.txt" {
+			if err := journal.recordDone(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 2*JournalSyncInterval; i++ {
+		move := renameMove{
+			Path:    filepath.Join(dir, fmt.Sprintf("foo%d", i)),
+			NewPath: filepath.Join(dir, fmt.Sprintf("bar%d", i)),
+		}
+		if err := journal.recordMove(move); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journal.recordMove(renameMove{Path: filepath.Join(dir, "foo_dir"), Mode: 0750}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{journal.ID, ""} {
+		loaded, err := LoadJournal(dir, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.ID != journal.ID || !reflect.DeepEqual(loaded.Args, journal.Args) || loaded.Undone {
+			t.Errorf("Unexpected journal: %+v", loaded)
+		}
+		if !reflect.DeepEqual(loaded.Entries, journal.Entries) {
+			t.Errorf("Unexpected entries: %d, expected: %d", len(loaded.Entries), len(journal.Entries))
+		}
+	}
+	if entry := journal.Entries[2]; entry.Path != "foo0" || entry.NewPath != "bar0" {
+		t.Errorf("Unexpected entry: %+v", entry)
+	}
+	if journal.Entries[0].Pending || !journal.Entries[1].Pending {
+		t.Errorf("Unexpected pending writes: %+v, %+v", journal.Entries[0], journal.Entries[1])
+	}
+
+	journal.Undone = true
+	if err := journal.save(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadJournal(dir, journal.ID); err != nil || !loaded.Undone || len(loaded.Entries) != len(journal.Entries) {
+		t.Errorf("Expected undone journal: %v", err)
+	}
+	if _, err := LoadJournal(dir, ""); err != ErrNoJournal {
+		t.Errorf("Expected no journal, actual: %v", err)
+	}
+}
+
+func BenchmarkJournal(b *testing.B) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the time per entry does not grow with the number of entries
+	for _, size := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				journal := NewJournal(dir, []string{"foo", "bar"})
+				journal.ID = fmt.Sprintf("%d-%d", size, i)
+				for n := 0; n < size; n++ {
+					journal.recordMove(renameMove{Path: filepath.Join(dir, "foo"), NewPath: filepath.Join(dir, "bar")})
+				}
+				journal.close()
+			}
+		})
+	}
+}
+
+func TestJournalCurrentPaths(t *testing.T) {
+	journal := NewJournal("/root", []string{"foo", "bar"})
+	journal.Entries = []*JournalEntry{
+		{Type: JournalWrite, Path: "foo_dir/foo.txt"},
+		{Type: JournalRename, Path: "foo_dir/foo.txt", NewPath: "foo_dir/bar.txt"},
+		{Type: JournalRename, Path: "foo_dir/x/a.txt", NewPath: "bar_dir/x/a.txt"},
+		{Type: JournalRemove, Path: "foo_dir/x"},
+		{Type: JournalRename, Path: "foo_dir", NewPath: "bar_dir/sub"},
+		{Type: JournalRename, Path: "foo.txt", NewPath: "bar.txt"},
+	}
+	expected := [][2]string{
+		{"bar_dir/sub/bar.txt", ""},
+		{"bar_dir/sub/foo.txt", "bar_dir/sub/bar.txt"},
+		{"bar_dir/sub/x/a.txt", "bar_dir/x/a.txt"},
+		{"bar_dir/sub/x", ""},
+		{"foo_dir", "bar_dir/sub"},
+		{"foo.txt", "bar.txt"},
+	}
+	paths, newPaths := journal.currentPaths()
+	for index := range journal.Entries {
+		actual := [2]string{paths[index].path(), ""}
+		if newPaths[index] != nil {
+			actual[1] = newPaths[index].path()
+		}
+		if actual != expected[index] {
+			t.Errorf("Entry #%d - expected: %v, actual: %v", index, expected[index], actual)
+		}
+	}
+}
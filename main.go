@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/jessevdk/go-flags"
@@ -20,30 +21,84 @@ var styleGreenUnderline = ansi.ColorFunc("green+u")
 var styleHeader = ansi.ColorFunc("white+b:black")
 var styleBold = ansi.ColorFunc("+b")
 
+// Exit codes like grep: something matched, nothing matched or an error
+// occurred. With --check a match is a failure, so it is the other way round.
+const (
+	ExitOK           = 0
+	ExitNoMatches    = 1
+	ExitCheckMatches = 1
+	ExitError        = 2
+)
+
 func main() {
 	dir, _ := os.Getwd()
-	exitCode := mainSub(dir, os.Stdout, os.Stdin, os.Args[1:])
-	if exitCode != 0 {
+	exitCode := mainSub(dir, os.Stdout, os.Stderr, os.Stdin, os.Args[1:])
+	if exitCode != ExitOK {
 		os.Exit(exitCode)
 	}
 }
 
 type options struct {
-	DryRun      bool `short:"d" long:"dry-run"     description:"Do not change anything"`
-	Regexp      bool `short:"r" long:"regexp"      description:"Treat search string as regular expression"`
-	Verbose     bool `short:"v" long:"verbose"     description:"Show verbose debug information"`
-	Interactive bool `short:"i" long:"interactive" description:"Confirm every replacement"`
-	Args        struct {
-		Search  string
-		Replace string
-	} `positional-args:"yes" required:"yes"`
+	DryRun        bool     `short:"d" long:"dry-run"     description:"Do not change anything"`
+	Regexp        bool     `short:"r" long:"regexp"      description:"Treat search string as regular expression"`
+	Verbose       bool     `short:"v" long:"verbose"     description:"Show verbose debug information"`
+	Interactive   bool     `short:"i" long:"interactive" description:"Confirm every replacement"`
+	Answers       string   `long:"answers"               description:"Read the answers of the interactive mode line by line from a file (- for stdin), implies --interactive" value-name:"FILE"`
+	PreserveCase  bool     `long:"preserve-case"         description:"Replace all case variants (fooBar, FooBar, foo_bar, FOO_BAR, foo-bar) in the same case"`
+	IgnoreCase    bool     `long:"ignore-case"           description:"Search case insensitive"`
+	SmartCase     bool     `long:"smart-case"            description:"Search case insensitive unless the search string contains upper case characters"`
+	Word          bool     `short:"w" long:"word"        description:"Match only whole words"`
+	Include       []string `long:"include"               description:"Only process files matching the gitignore style glob (repeatable)" value-name:"GLOB"`
+	Exclude       []string `long:"exclude"               description:"Skip files and directories matching the gitignore style glob (repeatable)" value-name:"GLOB"`
+	Type          []string `short:"t" long:"type"        description:"Only process files of the given type (repeatable, see --type-list)" value-name:"TYPE"`
+	TypeList      bool     `long:"type-list"             description:"Show all supported file types and exit"`
+	PreserveMtime bool     `long:"preserve-mtime"        description:"Keep the modification time of changed files"`
+	HardLinks     string   `long:"hard-links"            description:"Skip files with multiple hard links or write them in place" choice:"skip" choice:"in-place" default:"skip"`
+	Jobs          int      `short:"j" long:"jobs"        description:"Number of files processed in parallel (default: number of CPUs)" value-name:"N"`
+	Binary        bool     `long:"binary"                description:"Replace in binary files too, they are skipped by default"`
+	Encoding      string   `long:"encoding"              description:"Encoding of the files: auto, utf-8, latin1, utf-16le, utf-16be, utf-32le or utf-32be, auto detects UTF-16 and UTF-32 by their BOM and falls back to Latin-1 for invalid UTF-8" value-name:"NAME" default:"auto"`
+	Diff          bool     `long:"diff"                  description:"Print changes as unified diff instead of colored matches"`
+	Context       *int     `short:"C" long:"context"     description:"Show N lines before and after a match (default: 3)" value-name:"N"`
+	BeforeContext *int     `short:"B" long:"before-context" description:"Show N lines before a match" value-name:"N"`
+	AfterContext  *int     `short:"A" long:"after-context" description:"Show N lines after a match" value-name:"N"`
+	NoContext     bool     `long:"no-context"            description:"Show path:line:column and the changed line of a match only"`
+	SearchFile    string   `long:"search-file"           description:"Read the search string from a file, e.g. a block of several lines" value-name:"FILE"`
+	ReplaceFile   string   `long:"replace-file"          description:"Read the replace string from a file" value-name:"FILE"`
+	Rules         string   `long:"rules"                 description:"Read search and replace rules from a JSON file, all arguments are paths then" value-name:"FILE"`
+	FilesFrom     string   `long:"files-from"            description:"Only process the paths listed in a file (- for stdin), one per line" value-name:"FILE"`
+	Null          bool     `short:"0" long:"null"        description:"The paths of --files-from are separated by NUL characters (find -print0)"`
+	Format        string   `long:"format"                description:"Print colored text or one JSON event per line" choice:"text" choice:"json" default:"text"`
+	Color         string   `long:"color"                 description:"Color the output, auto colors a terminal unless NO_COLOR is set" choice:"auto" choice:"always" choice:"never" default:"auto"`
+	Check         bool     `long:"check"                 description:"Do not change anything, exit with 1 if anything matches (for CI)"`
+	OnConflict    string   `long:"on-conflict"           description:"What to do if the new name of a file or directory exists already: abort the run before anything is changed, skip the rename, merge directories or add a suffix (name-1.txt)" value-name:"POLICY" default:"abort"`
+	Args          struct {
+		Search  *string
+		Replace *string
+		Paths   []string `positional-arg-name:"Path"`
+	} `positional-args:"yes"`
 }
 
-func mainSub(workingDir string, stdout io.Writer, stdin io.Reader, args []string) int {
+// commands are executed instead of a search and replace if the first
+// argument is their name, use -- to search for a string with the same name.
+var commands = map[string]func(workingDir string, output *Output, stdin io.Reader, args []string) int{
+	"undo":  undoSub,
+	"plan":  planSub,
+	"apply": applySub,
+}
+
+func mainSub(workingDir string, stdout, stderr io.Writer, stdin io.Reader, args []string) int {
 
 	output := &Output{
-		stdout:  stdout,
-		verbose: false,
+		stdout:     stdout,
+		stderr:     stderr,
+		verbose:    false,
+		errorCount: new(int64),
+	}
+
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			return command(workingDir, output, stdin, args[1:])
+		}
 	}
 
 	opts, exitCode := parseOptions(output, args)
@@ -51,194 +106,1011 @@ func mainSub(workingDir string, stdout io.Writer, stdin io.Reader, args []string
 		return exitCode
 	}
 
+	program, exitCode := newProgram(workingDir, output, stdin, opts, args)
+	if program == nil {
+		return exitCode
+	}
+	return program.Execute()
+}
+
+// newProgram configures the output and creates the search and replace of the
+// options, it returns nil and the exit code if there is nothing to run.
+func newProgram(workingDir string, output *Output, stdin io.Reader, opts *options, args []string) (*Program, int) {
 	output.verbose = opts.Verbose
+	output.color = useColor(opts.Color, output.stdout)
+
+	if opts.TypeList {
+		output.print(typeList())
+		return nil, ExitOK
+	}
+
+	output.json = opts.Format == FormatJSON
+	output.compact = opts.NoContext
+
+	rules, err := buildRules(workingDir, opts)
+	if err != nil {
+		output.reportError("%s", err)
+		return nil, ExitError
+	}
 
 	filter := NewFilter(workingDir)
+	filter.SetOutput(output)
+	if err := configureFilter(filter, opts); err != nil {
+		output.reportError("%s", err)
+		return nil, ExitError
+	}
 
 	finder := &Finder{
 		output: output,
 		filter: filter,
 	}
 
+	writer := &FileWriter{
+		PreserveMtime: opts.PreserveMtime,
+		HardLinks:     opts.HardLinks,
+	}
+
+	if opts.Check {
+		opts.DryRun = true
+	}
+
+	var answers io.Reader
+	if opts.Answers == "-" {
+		answers = stdin
+	} else if opts.Answers != "" {
+		path := opts.Answers
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+		// the answers are read at once, so no file is left open
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			output.reportError("Could not open answers: %s (%s)", opts.Answers, err)
+			return nil, ExitError
+		}
+		answers = bytes.NewReader(data)
+	}
+
+	paths, err := buildPaths(workingDir, opts, stdin)
+	if err != nil {
+		output.reportError("%s", err)
+		return nil, ExitError
+	}
+
+	var journal *Journal
+	if !opts.DryRun {
+		journal = NewJournal(workingDir, args)
+	}
+
 	program := &Program{
-		Output: output,
-		Finder: finder,
+		Output:  output,
+		Finder:  finder,
+		Writer:  writer,
+		Journal: journal,
 
 		RootDirectory: workingDir,
-		Stdout:        stdout,
+		Stdout:        output.stdout,
 		Stdin:         stdin,
+		Answers:       answers,
 
-		// args
-		Search:  opts.Args.Search,
-		Replace: opts.Args.Replace,
+		Rules: rules,
+		Paths: paths,
 
 		// options
 		DryRun:      opts.DryRun,
+		Check:       opts.Check,
 		Verbose:     opts.Verbose,
-		Regexp:      opts.Regexp,
 		Interactive: opts.Interactive,
+		Diff:        opts.Diff,
+		Context:     contextLines(opts),
+		Jobs:        opts.Jobs,
+		Binary:      opts.Binary,
+		Encoding:    opts.Encoding,
+		OnConflict:  opts.OnConflict,
 	}
-	program.Execute()
-
-	return 0
+	return program, ExitOK
 }
 
 type Program struct {
-	Output *Output
-	Finder *Finder
+	Output  *Output
+	Finder  *Finder
+	Writer  *FileWriter
+	Journal *Journal
+	// Plan records the changes of a dry run, if not nil
+	Plan *Plan
 
 	RootDirectory string
 	Stdout        io.Writer
 	Stdin         io.Reader
+	// Answers replace Stdin for the questions of the interactive mode
+	Answers io.Reader
 
-	Search  string
-	Replace string
+	Rules []*Rule
+	// Paths are processed instead of the root directory, if not nil
+	Paths []string
 
 	DryRun      bool
+	Check       bool
 	Verbose     bool
-	Regexp      bool
 	Interactive bool
+	Diff        bool
+	Context     Context
+	Jobs        int
+	Binary      bool
+	// Encoding of the files, EncodingAuto detects it for every file
+	Encoding string
+	// OnConflict is the policy for renames to existing paths
+	OnConflict string
+
+	ask     *Ask
+	patch   *Patch
+	summary Summary
+	// renames is the tree as seen by the renames, it is simulated in a dry
+	// run
+	renames *renameTree
+	// acceptAll and quit answer all remaining questions of the interactive
+	// mode
+	acceptAll bool
+	quit      bool
+}
+
+// fileAnswers answer the remaining questions of the interactive mode for
+// the matches of a file, discard reverts the accepted ones.
+type fileAnswers struct {
+	accept, skip, discard bool
 }
 
-func (p *Program) Execute() {
-	p.Output.reportVerbose(
-		"(search: %s, replace: %s, dry-run: %v, regexp: %v)",
-		p.Search, p.Replace, p.DryRun, p.Regexp)
+// Execute runs the search and replace and returns the exit code.
+func (p *Program) Execute() int {
+	p.Output.reportVerbose("(dry-run: %v)", p.DryRun)
+	for index, rule := range p.Rules {
+		p.Output.reportVerbose("Rule #%d (%s)", index+1, rule)
+	}
 	p.Output.reportVerbose("Root-Directory: %s", p.RootDirectory)
+	p.summary = Summary{DryRun: p.DryRun}
 
-	if p.Regexp {
-		_, err := regexp.Compile(p.Search)
-		if err != nil {
+	for _, rule := range p.Rules {
+		if err := rule.compile(); err != nil {
 			p.Output.reportError(
 				"Could not compile regular expression: %s - %s",
-				p.Search, err)
-			return
+				rule.Search, err)
+			return ExitError
 		}
+		rule.replace.Context = &p.Context
 	}
 
-	replace := &Replace{
-		Search:  p.Search,
-		Replace: p.Replace,
-		Regexp:  p.Regexp,
+	if p.Answers != nil {
+		p.ask = NewAsk(p.Answers, p.Stdout)
+		p.ask.Echo = true
+	} else {
+		p.ask = NewAsk(p.Stdin, p.Stdout)
 	}
 
-	ask := &Ask{
-		Stdin:  p.Stdin,
-		Stdout: p.Stdout,
+	if p.Diff {
+		p.patch = NewPatch(p.RootDirectory)
 	}
 
-	entries := p.Finder.Find(p.RootDirectory)
+	// Step 0 - Find the conflicts of the renames before anything is changed,
+	// only the paths to rename are kept of this walk. The interactive mode
+	// finds the conflicts of the confirmed renames only, when they are
+	// renamed.
+	if p.hasNameRules() && !p.Interactive && !p.checkRenames(p.renameCandidates()) {
+		p.Output.reportError("Nothing changed, because of rename conflicts (see --on-conflict)")
+		return p.finish()
+	}
 
-	// iterate reversed, so directories are renamed after files are written
-	for i := len(entries) - 1; i >= 0; i-- {
-		path := entries[i]
+	// Step 1 - Replace search string in files content, the files are
+	// processed while the tree is walked again
+	renames := p.replaceContents(p.stream())
 
-		p.Output.reportVerbose(
-			"Processing(%d/%d) %s...", len(entries)-i, len(entries), p.shortenPath(path))
+	// Step 2 - Replace search string in file or directory name, iterate
+	// reversed, so directories are renamed after their content
+	p.renames = newRenameTree(p.DryRun)
+	for i := len(renames) - 1; i >= 0; i-- {
+		p.rename(renames[i])
+	}
 
-		file, err := os.Open(path)
-		if err != nil {
-			p.Output.reportError("Could not open: %s (%s)", p.shortenPath(path), err)
-			continue
+	if p.patch != nil {
+		p.patch.WriteTo(p.Stdout)
+	} else if p.Journal != nil && len(p.Journal.Entries) > 0 {
+		p.Output.reportInfo(
+			"Journal: %s (undo with: search-and-replace undo %s)",
+			p.Journal.ID, p.Journal.ID)
+	}
+	return p.finish()
+}
+
+// finish reports the summary and returns the exit code.
+func (p *Program) finish() int {
+	if p.Journal != nil {
+		if err := p.Journal.close(); err != nil {
+			p.Output.reportError("Could not write journal: %s", err)
 		}
-		fileInfo, err := file.Stat()
-		if err != nil {
-			p.Output.reportError("Could not stat: %s (%s)", p.shortenPath(path), err)
-			continue
+		if len(p.Journal.Entries) > 0 {
+			p.summary.Journal = p.Journal.ID
 		}
-		// close file directly (no defer) to prevent to many open files error
-		file.Close()
+	}
+	p.summary.Errors = p.Output.errors()
+	p.Output.reportSummary(p.summary)
+	return p.exitCode()
+}
+
+func (p *Program) stream() <-chan Entry {
+	if p.Paths != nil {
+		return p.Finder.StreamPaths(p.RootDirectory, p.Paths)
+	}
+	return p.Finder.Stream(p.RootDirectory)
+}
+
+// exitCode reports errors before matches, renamed files and directories
+// count as matches.
+func (p *Program) exitCode() int {
+	matched := p.summary.Matches > 0 || p.summary.Renames > 0
+	switch {
+	case p.summary.Errors > 0:
+		return ExitError
+	case p.Check && matched:
+		return ExitCheckMatches
+	case !p.Check && !matched:
+		return ExitNoMatches
+	default:
+		return ExitOK
+	}
+}
+
+type contentResult struct {
+	path string
+	// output and error output of the file, if it was processed by the
+	// worker pool
+	output, errors *bytes.Buffer
+
+	original []byte
+	content  string
+	// binary contents and text in UTF-16 or UTF-32 have no lines, which
+	// can be diffed
+	binary       bool
+	matches      int
+	replacements int
+	written      bool
+	skipped      bool
+	// failed files are not renamed
+	failed bool
+}
+
+// replaceContents replaces the content of all files as soon as they are
+// found. Files are processed by a pool of p.Jobs workers, their output is
+// buffered and printed in the order of the entries. The interactive mode
+// processes one file after another. It returns the paths of all entries,
+// which have to be renamed, in the order of the entries.
+func (p *Program) replaceContents(entries <-chan Entry) []string {
+	renames := []string{}
+	collect := func(entry Entry, result *contentResult) {
+		if entry.Err != nil {
+			p.Output.reportError("Could not read: %s (%s)", p.shortenPath(entry.Path), entry.Err)
+			return
+		}
+		if result != nil {
+			p.collectContent(result)
+			if result.failed {
+				return
+			}
+		}
+		if p.isRenamed(entry.Path) {
+			renames = append(renames, entry.Path)
+		}
+	}
 
-		// Step 1 - Replace search string in files content
-		if !fileInfo.IsDir() {
-			bytes, err := ioutil.ReadFile(path)
-			if err != nil {
-				p.Output.reportError("Could not read: %s (%s)", p.shortenPath(path), err)
+	jobs := p.Jobs
+	if jobs <= 0 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	if jobs == 1 || p.Interactive {
+		index := 0
+		for entry := range entries {
+			if p.quit {
+				// drain the finder
 				continue
 			}
+			index++
+			var result *contentResult
+			if entry.Err == nil && !entry.IsDir {
+				result = p.replaceContent(entry.Path, index, p.Output)
+			}
+			collect(entry, result)
+		}
+		return renames
+	}
 
-			matchCount := 0
-
-			content := string(bytes)
-			newContent := replace.Execute(content, func(info ReplacementInfo) bool {
-				matchCount++
-
-				p.Output.printHeader("Match #%d in %s", matchCount, p.shortenPath(path))
-				p.Output.reportReplacement(info)
-
-				if p.Interactive && !ask.question(styleBold("Replace?")) {
-					return false
-				}
-
-				return true
-			})
-			if newContent != content {
-				p.Output.reportInfo("Write: %s", p.shortenPath(path))
-				if !p.DryRun {
-					err = ioutil.WriteFile(path, []byte(newContent), fileInfo.Mode())
-					if err != nil {
-						p.Output.reportError(
-							"Could not write: %s (%s)", p.shortenPath(path), err)
-						continue
-					}
-				}
+	type job struct {
+		entry  Entry
+		index  int
+		result chan *contentResult
+	}
+	work := make(chan *job)
+	// the capacity bounds the number of jobs waiting for a slower predecessor
+	ordered := make(chan *job, 2*jobs)
+	go func() {
+		index := 0
+		for entry := range entries {
+			index++
+			j := &job{entry: entry, index: index, result: make(chan *contentResult, 1)}
+			ordered <- j
+			if entry.Err == nil && !entry.IsDir {
+				work <- j
+			} else {
+				j.result <- nil
 			}
 		}
+		close(work)
+		close(ordered)
+	}()
+	for i := 0; i < jobs; i++ {
+		go func() {
+			for j := range work {
+				var output, errors bytes.Buffer
+				result := p.replaceContent(j.entry.Path, j.index, p.Output.fork(&output, &errors))
+				result.output = &output
+				result.errors = &errors
+				j.result <- result
+			}
+		}()
+	}
+	for j := range ordered {
+		collect(j.entry, <-j.result)
+	}
+	return renames
+}
 
-		// Step 2 - Replace search string in file or directory name
-		baseName := filepath.Base(path)
-		newName := replace.Execute(baseName, func(info ReplacementInfo) bool {
+// collectContent prints the buffered output of a file and records its
+// changes, it is called in the order of the entries.
+func (p *Program) collectContent(result *contentResult) {
+	if result.output != nil {
+		p.Output.stdout.Write(result.output.Bytes())
+		p.Output.stderr.Write(result.errors.Bytes())
+	}
+	if result.original != nil {
+		p.summary.Files++
+	}
+	p.summary.Matches += result.matches
+	p.summary.Replacements += result.replacements
+	if result.skipped {
+		p.summary.Skipped++
+	}
+	if result.written || (p.DryRun && !result.failed && result.content != string(result.original)) {
+		p.summary.Writes++
+	}
+	if p.patch != nil && result.original != nil {
+		p.patch.addFile(result.path)
+		if result.content != string(result.original) {
+			p.patch.addChange(result.path, string(result.original), result.content, result.binary)
+		}
+	}
+	if p.Plan != nil && !result.failed && result.content != string(result.original) {
+		p.Plan.recordWrite(result.path, result.original, []byte(result.content))
+	}
+}
 
-			p.Output.printHeader("Rename %s to %s", p.shortenPath(path), info.ReplLine)
+// replaceContent replaces the search string in the content of a file, all
+// messages are reported to output.
+func (p *Program) replaceContent(path string, index int, output *Output) *contentResult {
+	result := &contentResult{path: path}
+
+	output.reportVerbose("Processing(%d) %s...", index, p.shortenPath(path))
+
+	file, err := os.Open(path)
+	if err != nil {
+		output.reportError("Could not open: %s (%s)", p.shortenPath(path), err)
+		result.failed = true
+		return result
+	}
+	fileInfo, err := file.Stat()
+	// close file directly (no defer) to prevent to many open files error
+	file.Close()
+	if err != nil {
+		output.reportError("Could not stat: %s (%s)", p.shortenPath(path), err)
+		result.failed = true
+		return result
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		output.reportError("Could not read: %s (%s)", p.shortenPath(path), err)
+		result.failed = true
+		return result
+	}
+	result.original = bytes
+	result.content = string(bytes)
+
+	encoding := textEncoding(bytes, p.Encoding)
+	result.binary = encoding == "" || isWideEncoding(encoding)
+	if encoding == "" {
+		if !p.Binary {
+			output.reportSkip(p.shortenPath(path), "binary")
+			result.skipped = true
+			return result
+		}
+	}
+
+	// matches and their context are shown in UTF-8 without BOM and with LF
+	// line breaks, the format of the file is restored when it is written.
+	// Binary content is searched as it is.
+	content, format, err := decodeText(bytes, encoding)
+	if err != nil {
+		output.reportWarning("Could not decode: %s (%s)", p.shortenPath(path), err)
+		output.reportSkip(p.shortenPath(path), "undecodable")
+		result.skipped = true
+		return result
+	}
+	answers := &fileAnswers{}
+	newContent := p.replaceEach(path, ScopeContent, content, func(in string) ReplaceCallback {
+		// matches are located in the bytes of the file, the matches of a
+		// later rule in the content written by the previous rules
+		location := newFileLocation(in, format)
+		return func(info *ReplacementInfo) bool {
+			result.matches++
 
-			if p.Interactive && !ask.question(styleBold("Rename?")) {
+			if p.quit || answers.skip {
 				return false
 			}
 
+			if p.showMatches() {
+				location.locate(info)
+				output.reportMatch(p.shortenPath(path), result.matches, info)
+			}
+
+			if p.Interactive && !p.confirm("Replace?", replaceAnswers, answers, info) {
+				return false
+			}
+
+			result.replacements++
 			return true
-		})
-		if newName != baseName {
-			newPath := filepath.Join(filepath.Dir(path), newName)
-			p.Output.reportInfo("Rename: %s", p.shortenPath(newPath))
-			if !p.DryRun {
-				err = os.Rename(path, newPath)
-				if err != nil {
-					p.Output.reportError("Could not move: %s (%s)", p.shortenPath(path), err)
-					continue
-				}
+		}
+	})
+	if answers.discard {
+		newContent = content
+		result.replacements = 0
+	}
+	if newContent == content {
+		return result
+	}
+	newBytes, err := format.encode(newContent)
+	if err != nil {
+		output.reportWarning("Could not encode: %s (%s)", p.shortenPath(path), err)
+		output.reportSkip(p.shortenPath(path), "unencodable")
+		result.skipped = true
+		result.failed = true
+		return result
+	}
+	result.content = string(newBytes)
+
+	if p.patch == nil {
+		output.reportWrite(p.shortenPath(path))
+	}
+	if p.DryRun {
+		return result
+	}
+	// the write is journaled before, so it can be undone even if the run
+	// is aborted in between
+	var entry *JournalEntry
+	if p.Journal != nil {
+		if entry, err = p.Journal.recordWrite(path, bytes, newBytes); err != nil {
+			output.reportError("Could not write journal: %s", err)
+			result.failed = true
+			return result
+		}
+	}
+	err = p.Writer.Write(path, newBytes, fileInfo)
+	if err == ErrHardLinked {
+		output.reportWarning(
+			"Skipped hard linked file: %s (use --hard-links=in-place)",
+			p.shortenPath(path))
+		output.reportSkip(p.shortenPath(path), "hard linked")
+		result.skipped = true
+		result.failed = true
+		return result
+	}
+	if err != nil {
+		output.reportError("Could not write: %s (%s)", p.shortenPath(path), err)
+		result.failed = true
+		return result
+	}
+	result.written = true
+	if entry != nil {
+		if err := p.Journal.recordDone(entry); err != nil {
+			output.reportError("Could not write journal: %s", err)
+		}
+	}
+	return result
+}
+
+// isRenamed reports whether the name of path contains the search string.
+func (p *Program) isRenamed(path string) bool {
+	baseName := filepath.Base(path)
+	return p.replace(path, ScopeNames, baseName, nil) != baseName
+}
+
+// rename replaces the search string in the name of a file or directory.
+func (p *Program) rename(path string) {
+	baseName := filepath.Base(path)
+	newName := p.replace(path, ScopeNames, baseName, func(info *ReplacementInfo) bool {
+
+		if p.quit {
+			return false
+		}
+
+		if p.showMatches() {
+			p.Output.printHeader("Rename %s to %s", p.shortenPath(path), info.ReplLine)
+		}
+
+		if p.Interactive && !p.confirm("Rename?", renameAnswers, &fileAnswers{}, info) {
+			return false
+		}
+
+		return true
+	})
+	if newName == baseName {
+		return
+	}
+
+	newPath := filepath.Join(filepath.Dir(path), newName)
+	moves, err := p.renames.resolve(path, newPath, p.OnConflict)
+	if _, ok := err.(*RenameConflict); ok && p.OnConflict == ConflictSkip {
+		p.Output.reportSkip(p.shortenPath(path), "rename conflict")
+		p.summary.Skipped++
+		return
+	}
+	if err != nil {
+		p.Output.reportError("Could not move: %s (%s)", p.shortenPath(path), p.conflictError(err))
+		return
+	}
+	if last := moves[len(moves)-1]; last.NewPath != "" {
+		// the new path may have a suffix, unless directories are merged
+		newPath = last.NewPath
+	}
+
+	if p.patch != nil {
+		p.patch.addRename(path, filepath.Base(newPath))
+	} else {
+		p.Output.reportRename(p.shortenPath(path), p.shortenPath(newPath))
+	}
+	for _, move := range moves {
+		p.renames.apply(move)
+		if p.DryRun {
+			if p.Plan != nil {
+				p.Plan.recordMove(move)
 			}
+			continue
+		}
+		if err := p.move(move); err != nil {
+			p.Output.reportError("Could not move: %s (%s)", p.shortenPath(move.Path), err)
+			return
+		}
+	}
+	p.summary.Renames++
+}
+
+// move makes a move of a rename and records it in the journal.
+func (p *Program) move(move renameMove) error {
+	var err error
+	if move.NewPath == "" {
+		err = os.Remove(move.Path)
+	} else {
+		err = os.Rename(move.Path, move.NewPath)
+	}
+	if err != nil {
+		return err
+	}
+	if p.Journal != nil {
+		if err := p.Journal.recordMove(move); err != nil {
+			p.Output.reportError("Could not write journal: %s", err)
+		}
+	}
+	return nil
+}
+
+// renameCandidates walks the tree and returns the paths, whose names contain
+// the search string, in the order of the walk.
+func (p *Program) renameCandidates() []string {
+	paths := []string{}
+	for entry := range p.stream() {
+		if entry.Err == nil && p.isRenamed(entry.Path) {
+			paths = append(paths, entry.Path)
+		}
+	}
+	return paths
+}
+
+// checkRenames finds the conflicts of the renames of the paths in a
+// simulated tree and reports them, it returns false if they abort the run.
+func (p *Program) checkRenames(paths []string) bool {
+	ok := true
+	tree := newRenameTree(true)
+	for i := len(paths) - 1; i >= 0; i-- {
+		path := paths[i]
+		newName := p.replace(path, ScopeNames, filepath.Base(path), nil)
+		newPath := filepath.Join(filepath.Dir(path), newName)
+		moves, err := tree.resolve(path, newPath, p.OnConflict)
+		conflict := fmt.Sprintf("Rename conflict: %s to %s", p.shortenPath(path), p.shortenPath(newPath))
+		_, isConflict := err.(*RenameConflict)
+		switch {
+		case isConflict && p.OnConflict == ConflictSkip:
+			p.Output.reportWarning("%s (%s), skipped", conflict, p.conflictError(err))
+		case err != nil:
+			p.Output.reportError("%s (%s)", conflict, p.conflictError(err))
+			ok = false
+		case moves[len(moves)-1].NewPath == "":
+			p.Output.reportWarning("%s (%s already exists), merged", conflict, p.shortenPath(newPath))
+		case moves[0].NewPath != newPath:
+			p.Output.reportWarning(
+				"%s (%s already exists), renamed to %s",
+				conflict, p.shortenPath(newPath), p.shortenPath(moves[0].NewPath))
+		}
+		for _, move := range moves {
+			tree.apply(move)
+		}
+	}
+	return ok
+}
+
+// conflictError returns the error message with a short path of a conflict.
+func (p *Program) conflictError(err error) string {
+	if conflict, ok := err.(*RenameConflict); ok {
+		return fmt.Sprintf("%s already exists", p.shortenPath(conflict.Existing))
+	}
+	return err.Error()
+}
+
+func (p *Program) hasNameRules() bool {
+	for _, rule := range p.Rules {
+		if rule.Scope != ScopeContent {
+			return true
 		}
 	}
-	return
+	return false
+}
+
+// confirm asks whether a match is replaced, unless a previous answer applies
+// to it too.
+func (p *Program) confirm(question string, choices []string, answers *fileAnswers, info *ReplacementInfo) bool {
+	if p.acceptAll || answers.accept {
+		return true
+	}
+	switch p.ask.question(p.Output.style(styleBold, question), choices) {
+	case AnswerYes:
+		return true
+	case AnswerAll:
+		p.acceptAll = true
+		return true
+	case AnswerQuit:
+		p.quit = true
+		return false
+	case AnswerSkipRest:
+		answers.skip = true
+		return false
+	case AnswerAcceptFile:
+		answers.accept = true
+		return true
+	case AnswerSkipFile:
+		answers.skip = true
+		answers.discard = true
+		return false
+	case AnswerEdit:
+		info.Repl = p.ask.edit(info.Repl)
+		return true
+	}
+	return false
+}
+
+// replace applies all rules of the given scope, which match the path, one
+// after another to the input.
+func (p *Program) replace(path, scope, in string, callback ReplaceCallback) string {
+	return p.replaceEach(path, scope, in, func(string) ReplaceCallback {
+		return callback
+	})
+}
+
+// replaceEach is replace with a callback for the input of every rule.
+func (p *Program) replaceEach(path, scope, in string, callback func(in string) ReplaceCallback) string {
+	for _, rule := range p.Rules {
+		if rule.appliesTo(p.shortenPath(path), scope) {
+			in = rule.replace.Execute(in, callback(in))
+		}
+	}
+	return in
+}
+
+// showMatches reports whether matches and renames are displayed, in diff
+// mode they are only needed to answer the questions of the interactive mode.
+func (p *Program) showMatches() bool {
+	return !p.Diff || p.Interactive
 }
 
 func (p *Program) shortenPath(path string) string {
 	return strings.Replace(path, p.RootDirectory+"/", "", 1)
 }
 
+// buildRules returns the rules of the rules file or the single rule given by
+// the positional arguments.
+func buildRules(workingDir string, opts *options) ([]*Rule, error) {
+	if opts.Rules != "" {
+		path := opts.Rules
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+		rules, err := LoadRules(path)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load rules: %s (%s)", opts.Rules, err)
+		}
+		return rules, nil
+	}
+
+	args := positionalArgs(opts)
+	search, replace := "", ""
+	if opts.SearchFile != "" {
+		content, err := readArgumentFile(workingDir, opts, opts.SearchFile)
+		if err != nil {
+			return nil, err
+		}
+		if content == "" {
+			return nil, fmt.Errorf("Empty search file: %s", opts.SearchFile)
+		}
+		search = content
+	} else {
+		search, args = args[0], args[1:]
+	}
+	if opts.ReplaceFile != "" {
+		content, err := readArgumentFile(workingDir, opts, opts.ReplaceFile)
+		if err != nil {
+			return nil, err
+		}
+		replace = content
+	} else {
+		replace = args[0]
+	}
+
+	rule := &Rule{
+		Search:  search,
+		Replace: replace,
+		Regexp:  opts.Regexp,
+
+		PreserveCase: opts.PreserveCase,
+		IgnoreCase:   opts.IgnoreCase,
+		SmartCase:    opts.SmartCase,
+		Word:         opts.Word,
+	}
+	return []*Rule{rule}, nil
+}
+
+// contextLines returns the number of lines shown before and after a match.
+func contextLines(opts *options) Context {
+	if opts.NoContext {
+		return Context{}
+	}
+	context := Context{ContextLineCount, ContextLineCount}
+	if opts.Context != nil {
+		context = Context{*opts.Context, *opts.Context}
+	}
+	if opts.BeforeContext != nil {
+		context.Before = *opts.BeforeContext
+	}
+	if opts.AfterContext != nil {
+		context.After = *opts.AfterContext
+	}
+	return context
+}
+
+// positionalArgs returns all positional arguments: the search and replace
+// string, unless they are read from files, followed by the paths.
+func positionalArgs(opts *options) []string {
+	args := []string{}
+	for _, arg := range []*string{opts.Args.Search, opts.Args.Replace} {
+		if arg != nil {
+			args = append(args, *arg)
+		}
+	}
+	return append(args, opts.Args.Paths...)
+}
+
+// patternArgCount returns the number of positional arguments, which are
+// the search and replace string.
+func patternArgCount(opts *options) int {
+	if opts.Rules != "" {
+		return 0
+	}
+	count := 2
+	if opts.SearchFile != "" {
+		count--
+	}
+	if opts.ReplaceFile != "" {
+		count--
+	}
+	return count
+}
+
+func readArgumentFile(workingDir string, opts *options, path string) (string, error) {
+	absPath := path
+	if !filepath.IsAbs(absPath) {
+		absPath = filepath.Join(workingDir, absPath)
+	}
+	content, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return "", fmt.Errorf("Could not read: %s (%s)", path, err)
+	}
+	// the file would match itself
+	excludeFile(workingDir, opts, absPath)
+	return string(content), nil
+}
+
+// excludeFile excludes a file given as an option from the search, if it is
+// inside of the working directory.
+func excludeFile(workingDir string, opts *options, path string) {
+	if rel, err := filepath.Rel(workingDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		opts.Exclude = append(opts.Exclude, "/"+filepath.ToSlash(rel))
+	}
+}
+
+// buildPaths returns the paths given as arguments and by --files-from, or nil
+// if the root directory is processed. With --rules all arguments are paths.
+func buildPaths(workingDir string, opts *options, stdin io.Reader) ([]string, error) {
+	var paths []string
+	if args := positionalArgs(opts); len(args) > patternArgCount(opts) {
+		paths = args[patternArgCount(opts):]
+	}
+
+	if opts.FilesFrom == "" {
+		return paths, nil
+	}
+	var data []byte
+	var err error
+	if opts.FilesFrom == "-" {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		path := opts.FilesFrom
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDir, path)
+		}
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read: %s (%s)", opts.FilesFrom, err)
+	}
+
+	separator := "\n"
+	if opts.Null {
+		separator = "\x00"
+	}
+	// not nil, so an empty list processes nothing
+	paths = append([]string{}, paths...)
+	for _, path := range strings.Split(string(data), separator) {
+		if !opts.Null {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func configureFilter(filter *Filter, opts *options) error {
+	includes, err := typePatterns(opts.Type)
+	if err != nil {
+		return err
+	}
+	includes = append(includes, opts.Include...)
+	if err := filter.SetIncludes(includes); err != nil {
+		return fmt.Errorf("Invalid include: %s", err)
+	}
+	if err := filter.SetExcludes(opts.Exclude); err != nil {
+		return fmt.Errorf("Invalid exclude: %s", err)
+	}
+	return nil
+}
+
 func parseOptions(output *Output, args []string) (*options, int) {
 	opts := options{}
 
 	parser := flags.NewParser(&opts, flags.PassDoubleDash|flags.HelpFlag)
-	args, err := parser.ParseArgs(args)
+	// commands are dispatched by mainSub, they are added for the help only
+	parser.SubcommandsOptional = true
+	parser.AddCommand("undo", "Undo the changes of a run (see undo --help)", "", &struct{}{})
+	parser.AddCommand("plan", "Write the changes of a dry run to a file (see plan --help)", "", &struct{}{})
+	parser.AddCommand("apply", "Apply the changes of a plan (see apply --help)", "", &struct{}{})
+	_, err := parser.ParseArgs(args)
 	if err != nil {
-		if parserErr, ok := err.(*flags.Error); ok {
-			if parserErr.Type != flags.ErrHelp {
-				output.printf("%s\n\n", parserErr.Message)
-			}
+		return nil, reportParserError(output, parser, err)
+	}
+	if exitCode, ok := checkOptions(output, parser, &opts); !ok {
+		return nil, exitCode
+	}
+	return &opts, ExitOK
+}
 
-			var b bytes.Buffer
-			parser.WriteHelp(&b)
-			output.printf("%s", b.String())
+// checkOptions checks the combination of the parsed options, if they are
+// invalid it prints the help and returns false and the exit code.
+func checkOptions(output *Output, parser *flags.Parser, opts *options) (int, bool) {
+	if opts.Answers != "" {
+		opts.Interactive = true
+	}
 
-			if parserErr.Type == flags.ErrHelp {
-				return nil, 0
-			}
-		} else {
-			panic(err)
+	var argsErr string
+	if len(positionalArgs(opts)) < patternArgCount(opts) {
+		argsErr = "the required arguments `Search` and `Replace` were not provided"
+	} else if args := positionalArgs(opts); opts.Rules == "" && opts.SearchFile == "" && args[0] == "" {
+		// an empty search string matches at every position
+		argsErr = "the search string must not be empty"
+	}
+	if opts.Rules != "" && (opts.SearchFile != "" || opts.ReplaceFile != "") {
+		argsErr = "--search-file and --replace-file can not be combined with --rules"
+	}
+	if opts.PreserveCase && opts.Regexp {
+		argsErr = "--preserve-case can not be combined with --regexp"
+	}
+	if opts.PreserveCase && (opts.IgnoreCase || opts.SmartCase) {
+		argsErr = "--preserve-case can not be combined with --ignore-case or --smart-case"
+	}
+	if opts.Format == FormatJSON && (opts.Interactive || opts.Diff) {
+		argsErr = "--format json can not be combined with --interactive or --diff"
+	}
+	for _, n := range []*int{opts.Context, opts.BeforeContext, opts.AfterContext} {
+		if n != nil && *n < 0 {
+			argsErr = "the number of context lines can not be negative"
 		}
-		return nil, 2
 	}
+	if opts.Null && opts.FilesFrom == "" {
+		argsErr = "--null requires --files-from"
+	}
+	if opts.FilesFrom == "-" && opts.Interactive && (opts.Answers == "" || opts.Answers == "-") {
+		argsErr = "--files-from - can not be combined with answers from stdin (use --answers FILE)"
+	}
+	if opts.Check && opts.Interactive {
+		argsErr = "--check can not be combined with --interactive"
+	}
+	if !isEncoding(opts.Encoding) {
+		argsErr = fmt.Sprintf("unknown encoding `%s`, use one of: %s", opts.Encoding, strings.Join(encodings, ", "))
+	}
+	if !isConflictPolicy(opts.OnConflict) {
+		argsErr = fmt.Sprintf("unknown conflict policy `%s`, use one of: %s", opts.OnConflict, strings.Join(conflictPolicies, ", "))
+	}
+	if opts.TypeList {
+		argsErr = ""
+	}
+	if argsErr != "" {
+		var b bytes.Buffer
+		parser.WriteHelp(&b)
+		output.printErrorf("%s\n\n%s", argsErr, b.String())
+		return ExitError, false
+	}
+	return ExitOK, true
+}
+
+// parseCommandOptions parses the options of a command, if parsing fails or
+// help was requested it returns false and the exit code.
+func parseCommandOptions(output *Output, name string, opts interface{}, args []string) (int, bool) {
+	parser := flags.NewNamedParser("search-and-replace "+name, flags.PassDoubleDash|flags.HelpFlag)
+	if _, err := parser.AddGroup("Command Options", "", opts); err != nil {
+		panic(err)
+	}
+	if _, err := parser.ParseArgs(args); err != nil {
+		return reportParserError(output, parser, err), false
+	}
+	return ExitOK, true
+}
+
+// reportParserError prints the error and the help message and returns the
+// exit code.
+func reportParserError(output *Output, parser *flags.Parser, err error) int {
+	parserErr, ok := err.(*flags.Error)
+	if !ok {
+		panic(err)
+	}
+	var b bytes.Buffer
+	parser.WriteHelp(&b)
 
-	return &opts, 0
+	if parserErr.Type == flags.ErrHelp {
+		output.printf("%s", b.String())
+		return ExitOK
+	}
+	output.printErrorf("%s\n\n%s", parserErr.Message, b.String())
+	return ExitError
 }
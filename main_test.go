@@ -8,9 +8,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -81,12 +83,56 @@ func TestMainExecute(t *testing.T) {
 
 		if *updateFlag {
 			t.Logf("Updating golden: %s...", goldenDir)
+			os.RemoveAll(filepath.Join(workingDir, JournalDirectory))
 			os.RemoveAll(goldenDir)
 			copyDirectory(workingDir, goldenDir)
 		}
 	}
 }
 
+func TestRulesFile(t *testing.T) {
+	referenceDir := "testdata/t5"
+	workingDir := referenceDir + ".got"
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	run(workingDir, []string{}, []string{"--rules", "../t5.rules.json"})
+	compare(t, 0, referenceDir+".golden", workingDir)
+}
+
+func TestRulesFileWithArguments(t *testing.T) {
+	referenceDir := "testdata/t5"
+	workingDir := referenceDir + ".got"
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	// the arguments are the paths to process
+	run(workingDir, []string{}, []string{"--rules", "../t5.rules.json", "client.go"})
+	for name, expectedDir := range map[string]string{
+		"client.go":     referenceDir + ".golden",
+		"foo_client.py": referenceDir,
+	} {
+		expected, _ := ioutil.ReadFile(filepath.Join(expectedDir, name))
+		actual, _ := ioutil.ReadFile(filepath.Join(workingDir, name))
+		if string(actual) != string(expected) {
+			t.Errorf("%s - expected:\n%s\nactual:\n%s", name, expected, actual)
+		}
+	}
+}
+
+func TestMissingArguments(t *testing.T) {
+	stdout := run("testdata/t3", []string{}, []string{"foo"})
+	assertContains(t, stdout, "the required arguments `Search` and `Replace` were not provided")
+
+	stdout, exitCode := runWithExitCode("testdata/t3", []string{}, []string{"", "foo"})
+	assertContains(t, stdout, "the search string must not be empty")
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+}
+
 func TestNotMovableFile(t *testing.T) {
 	workingDir := "testdata/t3"
 	os.Chmod(workingDir, 0555)
@@ -116,6 +162,377 @@ func TestHelpFlag(t *testing.T) {
 	assertContains(t, stdout, "Application Options")
 }
 
+func TestTypeList(t *testing.T) {
+	stdout := run("testdata/t3", []string{}, []string{"--type-list"})
+	assertContains(t, stdout, "go: *.go\n")
+}
+
+func TestIncludeAndExclude(t *testing.T) {
+	cases := []struct {
+		args        []string
+		expectedDir string
+	}{
+		{[]string{"--type", "css", "foo", "bar"}, "testdata/t1.golden"},
+		{[]string{"--type", "go", "foo", "bar"}, "testdata/t1"},
+		{[]string{"--include", "*.go", "foo", "bar"}, "testdata/t1"},
+		{[]string{"--exclude", "*.css", "foo", "bar"}, "testdata/t1"},
+	}
+	for index, c := range cases {
+		workingDir := "testdata/t1.got"
+
+		os.RemoveAll(workingDir)
+		copyDirectory("testdata/t1", workingDir)
+
+		run(workingDir, []string{}, c.args)
+		compare(t, index, c.expectedDir, workingDir)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	referenceDir := "testdata/t5"
+	workingDir := referenceDir + ".got"
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	// two runs, undone in reverse order
+	run(workingDir, []string{}, []string{"--rules", "../t5.rules.json"})
+	run(workingDir, []string{}, []string{"Bar", "Baz"})
+
+	stdout := run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Undone run")
+	compare(t, 0, referenceDir+".golden", workingDir)
+
+	stdout = run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Undone run")
+	compare(t, 1, referenceDir, workingDir)
+
+	stdout = run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Could not load journal: no journal found")
+}
+
+func TestUndoChangedFile(t *testing.T) {
+	referenceDir := "testdata/t1"
+	workingDir := referenceDir + ".got"
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	run(workingDir, []string{}, []string{"foo", "bar"})
+	ioutil.WriteFile(filepath.Join(workingDir, "bar.css"), []byte("changed"), 0644)
+
+	stdout := run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Changed since the run: bar.css")
+	assertContains(t, stdout, "nothing undone")
+
+	stdout = run(workingDir, []string{}, []string{"undo", "--force"})
+	assertContains(t, stdout, "Undone run")
+	compare(t, 0, referenceDir, workingDir)
+}
+
+// An aborted run leaves writes without a done record, the files may still
+// have their original content.
+func TestUndoPendingWrite(t *testing.T) {
+	referenceDir := "testdata/t1"
+	workingDir := referenceDir + ".got"
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	run(workingDir, []string{}, []string{"foo", "bar"})
+	journal, err := LoadJournal(workingDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(journal.path())
+	lines := []string{}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if !strings.Contains(line, `"type":"done"`) {
+			lines = append(lines, line)
+		}
+	}
+	ioutil.WriteFile(journal.path(), []byte(strings.Join(lines, "")), 0644)
+	// the first write did not happen, the file was renamed after it
+	paths, _ := journal.currentPaths()
+	backup, _ := ioutil.ReadFile(journal.backupPath(journal.Entries[0].Backup))
+	ioutil.WriteFile(journal.absolutePath(paths[0].path()), backup, 0644)
+
+	stdout := run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Undone run")
+	compare(t, 0, referenceDir, workingDir)
+}
+
+func TestPlanAndApply(t *testing.T) {
+	referenceDir := "testdata/t1"
+	workingDir := referenceDir + ".got"
+	planPath := filepath.Join(workingDir, "changes.json")
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	stdout, exitCode := runWithExitCode(workingDir, []string{}, []string{"plan", "-o", "changes.json", "foo", "bar"})
+	if exitCode != ExitOK {
+		t.Errorf("Unexpected exit code: %d\n%s", exitCode, stdout)
+	}
+	assertContains(t, stdout, "Plan: changes.json (apply with: search-and-replace apply changes.json)")
+	plan, _ := ioutil.ReadFile(planPath)
+	os.Remove(planPath)
+	compare(t, 0, referenceDir, workingDir)
+
+	// the plan itself is not part of the next plan
+	ioutil.WriteFile(planPath, plan, 0644)
+	run(workingDir, []string{}, []string{"plan", "-o", "changes.json", "foo", "bar"})
+	if replanned, _ := ioutil.ReadFile(planPath); strings.Contains(string(replanned), `"path": "changes.json"`) {
+		t.Errorf("Plan contains itself: %s", replanned)
+	}
+
+	stdout, exitCode = runWithExitCode(workingDir, []string{}, []string{"apply", "changes.json"})
+	if exitCode != ExitOK {
+		t.Errorf("Unexpected exit code: %d\n%s", exitCode, stdout)
+	}
+	assertContains(t, stdout, "Write: foo.css")
+	assertContains(t, stdout, "Rename: bar.css")
+	os.Remove(planPath)
+	compare(t, 1, referenceDir+".golden", workingDir)
+
+	stdout = run(workingDir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Undone run")
+	compare(t, 2, referenceDir, workingDir)
+}
+
+func TestApplyChangedFile(t *testing.T) {
+	referenceDir := "testdata/t1"
+	workingDir := referenceDir + ".got"
+	planPath := filepath.Join(workingDir, "changes.json")
+
+	os.RemoveAll(workingDir)
+	copyDirectory(referenceDir, workingDir)
+
+	run(workingDir, []string{}, []string{"plan", "-o", "changes.json", "foo", "bar"})
+	ioutil.WriteFile(filepath.Join(workingDir, "foo.css"), []byte("changed foo"), 0644)
+
+	stdout, exitCode := runWithExitCode(workingDir, []string{}, []string{"apply", "changes.json"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+	assertContains(t, stdout, "Could not write: foo.css (changed since the plan)")
+	if content, _ := ioutil.ReadFile(filepath.Join(workingDir, "foo.css")); string(content) != "changed foo" {
+		t.Errorf("Changed file was overwritten: %q", content)
+	}
+	os.Remove(planPath)
+
+	stdout, exitCode = runWithExitCode(workingDir, []string{}, []string{"plan", "foo", "bar"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+	assertContains(t, stdout, "the required flag `-o, --output' was not specified")
+}
+
+func TestApplyInvalidPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workingDir := filepath.Join(dir, "root")
+	os.Mkdir(workingDir, 0755)
+	outsidePath := filepath.Join(dir, "outside.txt")
+	ioutil.WriteFile(outsidePath, []byte("foo"), 0644)
+	ioutil.WriteFile(filepath.Join(workingDir, "foo.txt"), []byte("foo"), 0644)
+
+	hash := contentHash([]byte("foo"))
+	plan := fmt.Sprintf(`{"changes": [
+		{"type": "write", "path": "../outside.txt", "originalHash": %q, "content": "bar"},
+		{"type": "rename", "path": "foo.txt", "newPath": %q},
+		{"type": "write", "path": "sub/../foo.txt", "originalHash": %q, "content": "bar"}
+	]}`, hash, filepath.ToSlash(outsidePath), hash)
+	ioutil.WriteFile(filepath.Join(dir, "plan.json"), []byte(plan), 0644)
+
+	stdout, exitCode := runWithExitCode(workingDir, []string{}, []string{"apply", "../plan.json"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d\n%s", exitCode, stdout)
+	}
+	assertContains(t, stdout, "Invalid change: write ../outside.txt (../outside.txt is outside of the root directory)")
+	assertContains(t, stdout, "Invalid change: rename foo.txt")
+	assertContains(t, stdout, "Write: foo.txt")
+	if content, _ := ioutil.ReadFile(outsidePath); string(content) != "foo" {
+		t.Errorf("File outside of the root directory was changed: %q", content)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(workingDir, "foo.txt")); string(content) != "bar" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
+
+func TestRenameConflicts(t *testing.T) {
+	setup := func(paths ...string) string {
+		dir, err := ioutil.TempDir("", "search-and-replace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range paths {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+			ioutil.WriteFile(filepath.Join(dir, path), []byte(path+"\n"), 0644)
+		}
+		return dir
+	}
+	assertFiles := func(dir string, expected map[string]string) {
+		for path, content := range expected {
+			actual, err := ioutil.ReadFile(filepath.Join(dir, path))
+			if content == "" && os.IsNotExist(err) {
+				continue
+			}
+			if err != nil || string(actual) != content {
+				t.Errorf("%s - expected: %q, actual: %q (%v)", path, content, actual, err)
+			}
+		}
+	}
+	files := []string{"foo.txt", "bar.txt", "foo_dir/a.txt", "bar_dir/b.txt"}
+
+	_, exitCode := runWithExitCode(".", []string{}, []string{"--on-conflict", "overwrite", "foo", "bar"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code for unknown policy: %d", exitCode)
+	}
+
+	// nothing is changed, not even the content of other files
+	for _, args := range [][]string{{"foo", "bar"}, {"--dry-run", "foo", "bar"}} {
+		dir := setup(files...)
+		stdout, exitCode := runWithExitCode(dir, []string{}, args)
+		if exitCode != ExitError {
+			t.Errorf("%v - unexpected exit code: %d", args, exitCode)
+		}
+		assertContains(t, stdout, "Rename conflict: foo_dir to bar_dir (bar_dir already exists)")
+		assertContains(t, stdout, "Rename conflict: foo.txt to bar.txt (bar.txt already exists)")
+		assertContains(t, stdout, "Nothing changed, because of rename conflicts")
+		assertFiles(dir, map[string]string{
+			"foo.txt": "foo.txt\n", "bar.txt": "bar.txt\n", "foo_dir/a.txt": "foo_dir/a.txt\n",
+		})
+		os.RemoveAll(dir)
+	}
+
+	dir := setup(files...)
+	stdout, exitCode := runWithExitCode(dir, []string{}, []string{"--on-conflict", "skip", "foo", "bar"})
+	if exitCode != ExitOK {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+	assertContains(t, stdout, "Rename conflict: foo.txt to bar.txt (bar.txt already exists), skipped")
+	assertFiles(dir, map[string]string{
+		"foo.txt": "bar.txt\n", "bar.txt": "bar.txt\n",
+		"foo_dir/a.txt": "bar_dir/a.txt\n", "bar_dir/b.txt": "bar_dir/b.txt\n",
+	})
+	os.RemoveAll(dir)
+
+	dir = setup(files...)
+	stdout = run(dir, []string{}, []string{"--on-conflict", "suffix", "foo", "bar"})
+	assertContains(t, stdout, "Rename conflict: foo.txt to bar.txt (bar.txt already exists), renamed to bar-1.txt")
+	assertFiles(dir, map[string]string{
+		"bar-1.txt": "bar.txt\n", "bar.txt": "bar.txt\n",
+		"bar_dir-1/a.txt": "bar_dir/a.txt\n", "bar_dir/b.txt": "bar_dir/b.txt\n",
+	})
+	os.RemoveAll(dir)
+
+	// files can not be merged
+	dir = setup(files...)
+	stdout, exitCode = runWithExitCode(dir, []string{}, []string{"--on-conflict", "merge", "foo", "bar"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+	assertContains(t, stdout, "Rename conflict: foo_dir to bar_dir (bar_dir already exists), merged")
+	assertContains(t, stdout, "Rename conflict: foo.txt to bar.txt (bar.txt already exists)\n")
+	os.RemoveAll(dir)
+
+	// a declined rename does not abort an interactive run
+	dir = setup("bar.txt", "foo_dir/a.txt")
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("qux\n"), 0644)
+	stdout, exitCode = runWithExitCode(dir, []string{"y\n", "y\n", "n\n"}, []string{"--interactive", "foo", "bar"})
+	if exitCode != ExitOK {
+		t.Errorf("Unexpected exit code: %d\n%s", exitCode, stdout)
+	}
+	assertFiles(dir, map[string]string{
+		"foo.txt": "qux\n", "bar.txt": "bar.txt\n", "bar_dir/a.txt": "bar_dir/a.txt\n",
+	})
+	os.RemoveAll(dir)
+
+	dir = setup("foo_dir/a.txt", "foo_dir/sub/foo.txt", "bar_dir/b.txt", "bar_dir/sub/c.txt")
+	defer os.RemoveAll(dir)
+	os.Chmod(filepath.Join(dir, "foo_dir"), 0750)
+	stdout = run(dir, []string{}, []string{"--on-conflict", "merge", "foo", "bar"})
+	assertContains(t, stdout, "Rename: bar_dir")
+	assertFiles(dir, map[string]string{
+		"bar_dir/a.txt": "bar_dir/a.txt\n", "bar_dir/b.txt": "bar_dir/b.txt\n",
+		"bar_dir/sub/bar.txt": "bar_dir/sub/bar.txt\n", "bar_dir/sub/c.txt": "bar_dir/sub/c.txt\n",
+	})
+	if _, err := os.Stat(filepath.Join(dir, "foo_dir")); !os.IsNotExist(err) {
+		t.Errorf("Merged directory was not removed: %v", err)
+	}
+
+	stdout = run(dir, []string{}, []string{"undo"})
+	assertContains(t, stdout, "Undone run")
+	assertFiles(dir, map[string]string{
+		"foo_dir/a.txt": "foo_dir/a.txt\n", "foo_dir/sub/foo.txt": "foo_dir/sub/foo.txt\n",
+		"bar_dir/b.txt": "bar_dir/b.txt\n", "bar_dir/a.txt": "",
+	})
+	// the merged directory is created again with its mode
+	if fileInfo, err := os.Stat(filepath.Join(dir, "foo_dir")); err != nil || fileInfo.Mode().Perm() != 0750 {
+		t.Errorf("Unexpected mode of merged directory: %v (%v)", fileInfo.Mode(), err)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("sub%d/file%02d.txt", i%3, i))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(strings.Repeat("foo\n", i)), 0644)
+	}
+
+	sequential := run(dir, []string{}, []string{"--dry-run", "--jobs", "1", "foo", "bar"})
+	parallel := run(dir, []string{}, []string{"--dry-run", "--jobs", "8", "foo", "bar"})
+	if parallel != sequential {
+		t.Errorf("Output of parallel run differs:\n%s\n\nsequential:\n%s", parallel, sequential)
+	}
+	assertContains(t, parallel, "Match #49 in sub1/file49.txt")
+
+	run(dir, []string{}, []string{"--jobs", "8", "foo", "bar"})
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "sub1/file49.txt"))
+	if string(content) != strings.Repeat("bar\n", 49) {
+		t.Errorf("Unexpected content: %s", content)
+	}
+}
+
+func TestBinaryFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binaryPath := filepath.Join(dir, "image.png")
+	ioutil.WriteFile(binaryPath, []byte("\x89PNG\x00foo"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--verbose", "foo", "bar"})
+	assertContains(t, stdout, "Skip binary file: image.png")
+	if content, _ := ioutil.ReadFile(binaryPath); string(content) != "\x89PNG\x00foo" {
+		t.Errorf("Binary file was changed: %q", content)
+	}
+
+	run(dir, []string{}, []string{"--binary", "foo", "bar"})
+	if content, _ := ioutil.ReadFile(binaryPath); string(content) != "\x89PNG\x00bar" {
+		t.Errorf("Binary file was not changed: %q", content)
+	}
+
+	// the line breaks of binary files are not converted
+	ioutil.WriteFile(binaryPath, []byte("\x89PNG\x00a\r\nb\r\n"), 0644)
+	run(dir, []string{}, []string{"--binary", "--regexp", `\r`, ""})
+	if content, _ := ioutil.ReadFile(binaryPath); string(content) != "\x89PNG\x00a\nb\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
+
 func TestInteractiveMode(t *testing.T) {
 	cases := []struct {
 		referenceDir string
@@ -132,7 +549,7 @@ func TestInteractiveMode(t *testing.T) {
 			referenceDir: "testdata/t1",
 			expectedDir:  "testdata/t1",
 			// provide 4 no-answers
-			answers: []string{"n\n", "N\n", "w\n", "P\n"},
+			answers: []string{"n\n", "N\n", "n\n", "N\n"},
 		},
 	}
 	for index, c := range cases {
@@ -147,8 +564,498 @@ func TestInteractiveMode(t *testing.T) {
 	}
 }
 
+func TestInteractiveAnswers(t *testing.T) {
+	cases := []struct {
+		answers  []string
+		expected []string
+	}{
+		{[]string{"y\n", "n\n", "y\n", "y\n"}, []string{"bar foo\nbar\n", "bar\n"}},
+		{[]string{"a\n"}, []string{"bar bar\nbar\n", "bar\n"}},
+		{[]string{"y\n", "q\n"}, []string{"bar foo\nfoo\n", "foo\n"}},
+		{[]string{"y\n", "s\n", "y\n"}, []string{"bar foo\nfoo\n", "bar\n"}},
+		{[]string{"y\n", "S\n", "y\n"}, []string{"foo foo\nfoo\n", "bar\n"}},
+		{[]string{"n\n", "A\n", "n\n"}, []string{"foo bar\nbar\n", "foo\n"}},
+		{[]string{"e\n", "baz\n", "e\n", "\n", "n\n", "y\n"}, []string{"baz bar\nfoo\n", "bar\n"}},
+		{[]string{"x\n", "?\n", "n\n", "n\n", "n\n", "n\n"}, []string{"foo foo\nfoo\n", "foo\n"}},
+		// all answers in one read
+		{[]string{"y\nn\ny\ny\n"}, []string{"bar foo\nbar\n", "bar\n"}},
+		// the end of the input is quit
+		{[]string{"y\n"}, []string{"bar foo\nfoo\n", "foo\n"}},
+		{[]string{}, []string{"foo foo\nfoo\n", "foo\n"}},
+	}
+	for index, c := range cases {
+		dir, err := ioutil.TempDir("", "search-and-replace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		paths := []string{filepath.Join(dir, "x.txt"), filepath.Join(dir, "y.txt")}
+		ioutil.WriteFile(paths[0], []byte("foo foo\nfoo\n"), 0644)
+		ioutil.WriteFile(paths[1], []byte("foo\n"), 0644)
+
+		stdout := run(dir, c.answers, []string{"--interactive", "foo", "bar"})
+
+		for i, path := range paths {
+			content, _ := ioutil.ReadFile(path)
+			if string(content) != c.expected[i] {
+				t.Errorf(
+					"Case: #%d %q - %s expected: %q, actual: %q",
+					index, c.answers, filepath.Base(path), c.expected[i], content)
+			}
+		}
+		if len(c.answers) > 0 && c.answers[0] == "x\n" {
+			assertContains(t, stdout, "e - edit the replacement")
+		}
+	}
+}
+
+func TestAnswersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "x.txt")
+	ioutil.WriteFile(path, []byte("foo foo\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "answers.txt"), []byte("n\ny\n"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--answers", "answers.txt", "foo", "bar"})
+	assertContains(t, stdout, " [y,n,a,q,s,A,S,e,?]: n\n")
+	if content, _ := ioutil.ReadFile(path); string(content) != "foo bar\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	run(dir, []string{"y\n"}, []string{"--answers", "-", "foo", "bar"})
+	if content, _ := ioutil.ReadFile(path); string(content) != "bar bar\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	stdout = run(dir, []string{}, []string{"--answers", "missing.txt", "bar", "foo"})
+	assertContains(t, stdout, "Could not open answers: missing.txt")
+}
+
+func TestDiffMode(t *testing.T) {
+	for index, referenceDir := range []string{"testdata/t1", "testdata/t2"} {
+		// git apply skips the paths of a patch applied inside of a git
+		// repository, but outside of its root, so the patch is applied outside
+		// of the repository
+		tempDir, err := ioutil.TempDir("", "search-and-replace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+		workingDir := filepath.Join(tempDir, filepath.Base(referenceDir))
+		goldenDir := referenceDir + ".golden"
+
+		copyDirectory(referenceDir, workingDir)
+
+		patch := run(workingDir, []string{}, []string{"--dry-run", "--diff", "foo", "bar"})
+		compare(t, index, referenceDir, workingDir)
+
+		// the patch applied to the untouched directory must produce the golden directory
+		cmd := exec.Command("git", "apply", "-")
+		cmd.Dir = workingDir
+		cmd.Stdin = strings.NewReader(patch)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("Case #%d - git apply failed: %s\n%s\n%s", index, err, out, patch)
+		}
+		compare(t, index, goldenDir, workingDir)
+	}
+}
+
+func TestContextLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := ""
+	for i := 1; i <= 12; i++ {
+		content += fmt.Sprintf("line%d\n", i)
+	}
+	content = strings.Replace(content, "line9\n", "line9 foo\n", 1)
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0644)
+
+	stdout := run(dir, []string{}, []string{"--dry-run", "foo", "bar"})
+	assertContains(t, stdout, " 6   line6\n")
+	assertContains(t, stdout, " 9 - ")
+	assertContains(t, stdout, " 9 + ")
+	assertContains(t, stdout, "12   line12\n")
+	if strings.Contains(stdout, "line5") {
+		t.Errorf("Expected 3 lines before the match:\n%s", stdout)
+	}
+
+	stdout = run(dir, []string{}, []string{"--dry-run", "-C", "1", "-A", "0", "foo", "bar"})
+	assertContains(t, stdout, "8   line8\n")
+	if strings.Contains(stdout, "line7") || strings.Contains(stdout, "line10") {
+		t.Errorf("Expected 1 line before and none after the match:\n%s", stdout)
+	}
+
+	stdout = run(dir, []string{}, []string{"--dry-run", "--no-context", "foo", "bar"})
+	assertContains(t, stdout, "file.txt:9:7: ")
+	if strings.Contains(stdout, "line8") || strings.Contains(stdout, "Match #1") {
+		t.Errorf("Expected the changed line only:\n%s", stdout)
+	}
+}
+
+func TestSearchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	patternDir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(patternDir)
+
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("// old\r\n// header\r\ncode\r\n"), 0644)
+	searchFile := filepath.Join(patternDir, "search.txt")
+	ioutil.WriteFile(searchFile, []byte("// old\n// header\n"), 0644)
+	replaceFile := filepath.Join(patternDir, "replace.txt")
+	ioutil.WriteFile(replaceFile, []byte("// new\n// header\n"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--search-file", searchFile, "--replace-file", replaceFile})
+	if content, _ := ioutil.ReadFile(path); string(content) != "// new\r\n// header\r\ncode\r\n" {
+		t.Errorf("Unexpected content: %q\n%s", content, stdout)
+	}
+
+	// the replace string and a path as arguments
+	run(dir, []string{}, []string{"--search-file", replaceFile, "", "file.txt"})
+	if content, _ := ioutil.ReadFile(path); string(content) != "code\r\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	stdout = run(dir, []string{}, []string{"--search-file", "missing.txt", "foo"})
+	assertContains(t, stdout, "Could not read: missing.txt")
+
+	// files inside of the working directory are not searched
+	ioutil.WriteFile(filepath.Join(dir, "search.txt"), []byte("code"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "replace.txt"), []byte("text code"), 0644)
+	run(dir, []string{}, []string{"--search-file", "search.txt", "--replace-file", "replace.txt"})
+	if content, _ := ioutil.ReadFile(path); string(content) != "text code\r\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+	for name, expected := range map[string]string{"search.txt": "code", "replace.txt": "text code"} {
+		if content, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(content) != expected {
+			t.Errorf("Unexpected content of %s: %q", name, content)
+		}
+	}
+
+	emptyFile := filepath.Join(patternDir, "empty.txt")
+	ioutil.WriteFile(emptyFile, []byte{}, 0644)
+	stdout = run(dir, []string{}, []string{"--search-file", emptyFile, "foo"})
+	assertContains(t, stdout, "Empty search file: "+emptyFile)
+	if content, _ := ioutil.ReadFile(path); string(content) != "text code\r\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
+
+func TestLineBreaksAndBOM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("\xEF\xBB\xBFfoo\r\nbar foo\r\n"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--regexp", "(?m)^foo|foo$", "x\ny"})
+	expected := "\xEF\xBB\xBFx\r\ny\r\nbar x\r\ny\r\n"
+	if content, _ := ioutil.ReadFile(path); string(content) != expected {
+		t.Errorf("expected: %q, actual: %q", expected, content)
+	}
+	if strings.Contains(stdout, "\r") {
+		t.Errorf("Unexpected CR in output: %q", stdout)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"latin1.txt":  "caf\xe9 foo\n",
+		"utf16le.txt": "\xFF\xFEf\x00o\x00o\x00\r\x00\n\x00",
+		"utf16be.txt": "\x00f\x00o\x00o\x00\n",
+		"invalid.txt": "\xFF\xFEf\x00o\x00o\x00\x00\xD8",
+	}
+	for path, content := range files {
+		ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0644)
+	}
+
+	expected := map[string]string{
+		"latin1.txt":  "caf\xe9 b\xe4r\n",
+		"utf16le.txt": "\xFF\xFEb\x00\xe4\x00r\x00\r\x00\n\x00",
+		"utf16be.txt": "\x00b\x00\xe4\x00r\x00\n",
+		"invalid.txt": files["invalid.txt"],
+	}
+
+	// UTF-16 files are diffed as git binary patch
+	patch := run(dir, []string{}, []string{"--dry-run", "--diff", "foo", "bär"})
+	assertContains(t, patch, "diff --git a/utf16le.txt b/utf16le.txt\nindex ")
+	assertContains(t, patch, "GIT binary patch\nliteral 12\n")
+	patchDir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(patchDir)
+	patchDir = filepath.Join(patchDir, "tree")
+	copyDirectory(dir, patchDir)
+	cmd := exec.Command("git", "apply", "-")
+	cmd.Dir = patchDir
+	cmd.Stdin = strings.NewReader(patch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("git apply failed: %s\n%s\n%s", err, out, patch)
+	}
+	for path, content := range expected {
+		if actual, _ := ioutil.ReadFile(filepath.Join(patchDir, path)); string(actual) != content {
+			t.Errorf("Patched %s - expected: %q, actual: %q", path, content, actual)
+		}
+	}
+
+	stdout := run(dir, []string{}, []string{"--verbose", "foo", "bär"})
+	for path, content := range expected {
+		if actual, _ := ioutil.ReadFile(filepath.Join(dir, path)); string(actual) != content {
+			t.Errorf("%s - expected: %q, actual: %q", path, content, actual)
+		}
+	}
+	assertContains(t, stdout, "Could not decode: invalid.txt (invalid utf-16le at byte 6)")
+	assertContains(t, stdout, "Skip undecodable file: invalid.txt")
+
+	stdout = run(dir, []string{}, []string{"--verbose", "--encoding", "latin1", "café", "€"})
+	if actual, _ := ioutil.ReadFile(filepath.Join(dir, "latin1.txt")); string(actual) != expected["latin1.txt"] {
+		t.Errorf("Unencodable file was changed: %q", actual)
+	}
+	assertContains(t, stdout, "Could not encode: latin1.txt ('€' is not a latin1 character)")
+	assertContains(t, stdout, "Skip unencodable file: latin1.txt")
+
+	stdout, exitCode := runWithExitCode(dir, []string{}, []string{"--encoding", "ascii", "foo", "bar"})
+	if exitCode != ExitError {
+		t.Errorf("Unexpected exit code: %d", exitCode)
+	}
+	assertContains(t, stdout, "unknown encoding `ascii`, use one of: auto, utf-8, latin1")
+}
+
+func TestPathArguments(t *testing.T) {
+	setup := func() string {
+		dir, err := ioutil.TempDir("", "search-and-replace")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"a/foo.txt", "b/foo.txt", "c.txt", "foo_dir/x.txt"} {
+			os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+			ioutil.WriteFile(filepath.Join(dir, path), []byte("foo\n"), 0644)
+		}
+		return dir
+	}
+	assertFiles := func(dir string, expected map[string]string) {
+		for path, content := range expected {
+			actual, err := ioutil.ReadFile(filepath.Join(dir, path))
+			if err != nil || string(actual) != content {
+				t.Errorf("%s - expected: %q, actual: %q (%v)", path, content, actual, err)
+			}
+		}
+	}
+
+	dir := setup()
+	defer os.RemoveAll(dir)
+	run(dir, []string{}, []string{"foo", "bar", "a", "c.txt"})
+	assertFiles(dir, map[string]string{
+		"a/bar.txt":     "bar\n",
+		"b/foo.txt":     "foo\n",
+		"c.txt":         "bar\n",
+		"foo_dir/x.txt": "foo\n",
+	})
+
+	dir = setup()
+	defer os.RemoveAll(dir)
+	stdin := []string{"foo_dir/x.txt\x00b/foo.txt\x00foo_dir\x00"}
+	run(dir, stdin, []string{"--files-from", "-", "-0", "foo", "bar"})
+	assertFiles(dir, map[string]string{
+		"a/foo.txt":     "foo\n",
+		"b/bar.txt":     "bar\n",
+		"c.txt":         "foo\n",
+		"bar_dir/x.txt": "bar\n",
+	})
+
+	dir = setup()
+	defer os.RemoveAll(dir)
+	_, exitCode := runWithExitCode(dir, []string{}, []string{"--files-from", "-", "foo", "bar"})
+	if exitCode != ExitNoMatches {
+		t.Errorf("Expected no matches for an empty list, exit code: %d", exitCode)
+	}
+	assertFiles(dir, map[string]string{"c.txt": "foo\n"})
+}
+
+func TestColorAndStderr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("foo\n"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--dry-run", "foo", "bar"})
+	if strings.Contains(stdout, "\x1b[") {
+		t.Errorf("Unexpected color:\n%q", stdout)
+	}
+	stdout = run(dir, []string{}, []string{"--dry-run", "--color", "always", "foo", "bar"})
+	assertContains(t, stdout, "\x1b[")
+
+	var out, errOut bytes.Buffer
+	mainSub(dir, &out, &errOut, &StringReader{}, []string{"--regexp", "(", "bar"})
+	assertContains(t, errOut.String(), "[ERROR] Could not compile regular expression")
+	if out.Len() != 0 {
+		t.Errorf("Unexpected output on stdout:\n%s", out.String())
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("a\nb foo\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "image.png"), []byte("\x89PNG\x00foo"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--format", "json", "--jobs", "2", "foo", "bar"})
+
+	events := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(stdout, "\n"), "\n") {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid event: %s (%s)", line, err)
+		}
+		events = append(events, event)
+	}
+
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event["type"].(string))
+	}
+	expectedTypes := []string{"match", "write", "skip", "rename", "summary"}
+	if fmt.Sprint(types) != fmt.Sprint(expectedTypes) {
+		t.Fatalf("Expected events: %v, actual: %v\n%s", expectedTypes, types, stdout)
+	}
+
+	match := events[0]
+	expectedMatch := map[string]interface{}{
+		"path": "foo.txt", "line": 2.0, "column": 3.0, "start": 4.0, "end": 7.0,
+		"match": "foo", "replacement": "bar",
+	}
+	for key, value := range expectedMatch {
+		if match[key] != value {
+			t.Errorf("Match %s - expected: %v, actual: %v", key, value, match[key])
+		}
+	}
+	if events[2]["path"] != "image.png" || events[2]["reason"] != "binary" {
+		t.Errorf("Unexpected skip event: %v", events[2])
+	}
+	if events[3]["newPath"] != "bar.txt" {
+		t.Errorf("Rename - expected: bar.txt, actual: %v", events[3]["newPath"])
+	}
+
+	summary := events[4]
+	expectedSummary := map[string]interface{}{
+		"files": 2.0, "matches": 1.0, "replacements": 1.0, "writes": 1.0,
+		"renames": 1.0, "skipped": 1.0, "errors": 0.0,
+	}
+	for key, value := range expectedSummary {
+		if summary[key] != value {
+			t.Errorf("Summary %s - expected: %v, actual: %v", key, value, summary[key])
+		}
+	}
+
+	stdout = run(dir, []string{}, []string{"--format", "json", "--diff", "foo", "bar"})
+	assertContains(t, stdout, "--format json can not be combined with --interactive or --diff")
+}
+
+// The offsets of matches are bytes of the file, with its BOM, line breaks and
+// encoding.
+func TestJSONFormatOffsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("\xEF\xBB\xBFa\r\nb\r\nc foo foo\r\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("\xFF\xFEa\x00\r\x00\n\x00\xE9\x00f\x00o\x00o\x00"), 0644)
+
+	stdout := run(dir, []string{}, []string{"--format", "json", "--dry-run", "--jobs", "1", "foo", "bar"})
+	matches := [][]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(stdout, "\n"), "\n") {
+		event := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid event: %s (%s)", line, err)
+		}
+		if event["type"] == "match" {
+			matches = append(matches, []interface{}{event["path"], event["line"], event["column"], event["start"], event["end"]})
+		}
+	}
+	expected := [][]interface{}{
+		{"a.txt", 3.0, 3.0, 11.0, 14.0},
+		{"a.txt", 3.0, 7.0, 15.0, 18.0},
+		{"b.txt", 2.0, 3.0, 10.0, 16.0},
+	}
+	if fmt.Sprint(matches) != fmt.Sprint(expected) {
+		t.Errorf("Expected matches: %v, actual: %v\n%s", expected, matches, stdout)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file.txt")
+	ioutil.WriteFile(path, []byte("foo\n"), 0644)
+
+	cases := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"--dry-run", "foo", "bar"}, ExitOK},
+		{[]string{"--dry-run", "file", "bar"}, ExitOK},
+		{[]string{"--dry-run", "qux", "bar"}, ExitNoMatches},
+		{[]string{"--check", "foo", "bar"}, ExitCheckMatches},
+		{[]string{"--check", "file", "bar"}, ExitCheckMatches},
+		{[]string{"--check", "qux", "bar"}, ExitOK},
+		{[]string{"--check", "--interactive", "foo", "bar"}, ExitError},
+		{[]string{"--regexp", "(", "bar"}, ExitError},
+		{[]string{"foo"}, ExitError},
+	}
+	for index, c := range cases {
+		stdout, exitCode := runWithExitCode(dir, []string{}, c.args)
+		if exitCode != c.expected {
+			t.Errorf("Case: #%d %v - expected: %d, actual: %d\n%s", index, c.args, c.expected, exitCode, stdout)
+		}
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "foo\n" {
+		t.Errorf("File was changed: %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, JournalDirectory)); !os.IsNotExist(err) {
+		t.Errorf("Journal was written")
+	}
+}
+
 func compare(t *testing.T, index int, compareDir, workingDir string) {
-	cmd := exec.Command("diff", "-ru", workingDir, compareDir)
+	cmd := exec.Command("diff", "-ru", "-x", JournalDirectory, workingDir, compareDir)
 	cmd.Stdout = new(bytes.Buffer)
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
@@ -159,11 +1066,31 @@ func compare(t *testing.T, index int, compareDir, workingDir string) {
 }
 
 func run(workingDir string, stdinStr, args []string) string {
+	stdout, _ := runWithExitCode(workingDir, stdinStr, args)
+	return stdout
+}
+
+func runWithExitCode(workingDir string, stdinStr, args []string) (string, int) {
 	stdin := &StringReader{data: stdinStr}
+	// errors are written to stdout too, to keep them in order
 	var stdout bytes.Buffer
-	mainSub(workingDir, &stdout, stdin, args)
+	exitCode := mainSub(workingDir, &stdout, &stdout, stdin, args)
 
-	return stdout.String()
+	return stdout.String(), exitCode
+}
+
+// setenv sets an environment variable for the test and restores its previous
+// value afterwards.
+func setenv(t *testing.T, key, value string) {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
 }
 
 func copyDirectory(source, target string) {
@@ -1,47 +1,301 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
 )
 
 type Output struct {
-	stdout  io.Writer
+	stdout io.Writer
+	// stderr receives errors and warnings, unless json is set
+	stderr  io.Writer
 	verbose bool
+	color   bool
+	// json switches to a stream of JSON events, one per line (NDJSON)
+	json bool
+	// compact prints a match as path:line:column and the changed line
+	compact bool
+	// errorCount is shared by all forks of the output
+	errorCount *int64
+}
+
+// Summary counts the results of a run.
+type Summary struct {
+	DryRun       bool `json:"dryRun"`
+	Files        int  `json:"files"`
+	Matches      int  `json:"matches"`
+	Replacements int  `json:"replacements"`
+	Writes       int  `json:"writes"`
+	Renames      int  `json:"renames"`
+	Skipped      int  `json:"skipped"`
+	Errors       int  `json:"errors"`
+	// Journal is the id of the run, if anything was changed
+	Journal string `json:"journal,omitempty"`
+}
+
+type jsonEvent struct {
+	Type    string `json:"type"`
+	Path    string `json:"path,omitempty"`
+	NewPath string `json:"newPath,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type jsonMatchEvent struct {
+	Type        string           `json:"type"`
+	Path        string           `json:"path"`
+	Line        int              `json:"line"`
+	Column      int              `json:"column"`
+	Start       int              `json:"start"`
+	End         int              `json:"end"`
+	Match       string           `json:"match"`
+	Replacement string           `json:"replacement"`
+	Context     jsonMatchContext `json:"context"`
+}
+
+type jsonMatchContext struct {
+	Before string `json:"before"`
+	Line   string `json:"line"`
+	After  string `json:"after"`
+}
+
+type jsonSummaryEvent struct {
+	Type string `json:"type"`
+	Summary
+}
+
+// fork returns a copy of the output, which writes to stdout and stderr.
+func (o *Output) fork(stdout, stderr io.Writer) *Output {
+	forked := *o
+	forked.stdout = stdout
+	forked.stderr = stderr
+	return &forked
+}
+
+// useColor decides whether the output is colored: always and never are
+// given by the --color flag, auto colors a terminal unless NO_COLOR is set.
+func useColor(mode string, w io.Writer) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	// other character devices like /dev/null are no terminal
+	return isatty.IsTerminal(file.Fd()) || isatty.IsCygwinTerminal(file.Fd())
 }
 
 func (o *Output) reportError(format string, a ...interface{}) {
-	fmt.Fprintf(o.stdout, "[ERROR] "+format+"\n", a...)
+	if o.errorCount != nil {
+		atomic.AddInt64(o.errorCount, 1)
+	}
+	if o.json {
+		o.emit(jsonEvent{Type: "error", Message: fmt.Sprintf(format, a...)})
+		return
+	}
+	fmt.Fprintf(o.stderr, "[ERROR] "+format+"\n", a...)
+}
+
+func (o *Output) reportWarning(format string, a ...interface{}) {
+	if o.json {
+		o.emit(jsonEvent{Type: "warning", Message: fmt.Sprintf(format, a...)})
+		return
+	}
+	fmt.Fprintf(o.stderr, "[WARNING] "+format+"\n", a...)
 }
 
 func (o *Output) reportInfo(format string, a ...interface{}) {
+	if o.json {
+		return
+	}
 	fmt.Fprintf(o.stdout, "[INFO] "+format+"\n", a...)
 }
 
-func (o *Output) reportReplacement(info ReplacementInfo) {
-	o.print(info.LinesBeforeMatch)
+func (o *Output) reportMatch(path string, number int, info *ReplacementInfo) {
+	if o.json {
+		o.emit(jsonMatchEvent{
+			Type:        "match",
+			Path:        path,
+			Line:        info.LineNumber,
+			Column:      info.Column,
+			Start:       info.MatchIndex[0],
+			End:         info.MatchIndex[1],
+			Match:       info.Match,
+			Replacement: info.Repl,
+			Context: jsonMatchContext{
+				Before: info.LinesBeforeMatch,
+				Line:   info.MatchLine,
+				After:  info.LinesAfterMatch,
+			},
+		})
+		return
+	}
+	if o.compact {
+		o.printf("%s:%d:%d: ", path, info.LineNumber, info.Column)
+		o.print(o.styleLines(styleGreen, info.ReplLine[:info.ReplLineReplIndex[0]]))
+		o.print(o.styleLines(styleGreenUnderline, info.Repl))
+		o.print(o.styleLines(styleGreen, strings.TrimSuffix(info.ReplLine[info.ReplLineReplIndex[1]:], "\n")))
+		o.print("\n")
+		return
+	}
+	o.printHeader("Match #%d in %s", number, path)
+	o.reportReplacement(info)
+}
+
+func (o *Output) reportWrite(path string) {
+	if o.json {
+		o.emit(jsonEvent{Type: "write", Path: path})
+		return
+	}
+	o.reportInfo("Write: %s", path)
+}
+
+func (o *Output) reportRename(path, newPath string) {
+	if o.json {
+		o.emit(jsonEvent{Type: "rename", Path: path, NewPath: newPath})
+		return
+	}
+	o.reportInfo("Rename: %s", newPath)
+}
+
+func (o *Output) reportSkip(path, reason string) {
+	if o.json {
+		o.emit(jsonEvent{Type: "skip", Path: path, Reason: reason})
+		return
+	}
+	o.reportVerbose("Skip %s file: %s", reason, path)
+}
+
+func (o *Output) reportSummary(summary Summary) {
+	if o.json {
+		o.emit(jsonSummaryEvent{Type: "summary", Summary: summary})
+		return
+	}
+	o.reportVerbose(
+		"Summary: %d files, %d matches, %d replacements, %d writes, %d renames, %d skipped, %d errors",
+		summary.Files, summary.Matches, summary.Replacements, summary.Writes,
+		summary.Renames, summary.Skipped, summary.Errors)
+}
+
+func (o *Output) errors() int {
+	if o.errorCount == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(o.errorCount))
+}
+
+func (o *Output) emit(event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		panic(err)
+	}
+	o.stdout.Write(append(data, '\n'))
+}
+
+// reportReplacement prints the changed lines with their context, the line
+// numbers are printed in the gutter.
+func (o *Output) reportReplacement(info *ReplacementInfo) {
+	before := strings.Count(info.LinesBeforeMatch, "\n")
+	matchLines := strings.Count(strings.TrimSuffix(info.MatchLine, "\n"), "\n") + 1
+	last := info.LineNumber + matchLines - 1
+	if info.LinesAfterMatch != "" {
+		last += strings.Count(strings.TrimSuffix(info.LinesAfterMatch, "\n"), "\n") + 1
+	}
+	width := len(strconv.Itoa(last))
+
+	o.printLines(info.LineNumber-before, width, " ", info.LinesBeforeMatch)
+
+	o.printLines(info.LineNumber, width, "-",
+		o.styleLines(styleRed, info.MatchLine[:info.MatchLineMatchIndex[0]])+
+			o.styleLines(styleRedUnderline, info.Match)+
+			o.styleLines(styleRed, info.MatchLine[info.MatchLineMatchIndex[1]:]))
+
+	o.printLines(info.LineNumber, width, "+",
+		o.styleLines(styleGreen, info.ReplLine[:info.ReplLineReplIndex[0]])+
+			o.styleLines(styleGreenUnderline, info.Repl)+
+			o.styleLines(styleGreen, info.ReplLine[info.ReplLineReplIndex[1]:]))
+
+	o.printLines(info.LineNumber+matchLines, width, " ", info.LinesAfterMatch)
+}
 
-	o.print(styleRed(info.MatchLine[:info.MatchLineMatchIndex[0]]))
-	o.print(styleRedUnderline(info.Match))
-	o.print(styleRed(info.MatchLine[info.MatchLineMatchIndex[1]:]))
+// printLines prints every line of s behind its number and the marker.
+func (o *Output) printLines(number, width int, marker, s string) {
+	if s == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		o.printf("%*d %s %s\n", width, number, marker, line)
+		number++
+	}
+}
 
-	o.print(styleGreen(info.ReplLine[:info.ReplLineReplIndex[0]]))
-	o.print(styleGreenUnderline(info.Repl))
-	o.print(styleGreen(info.ReplLine[info.ReplLineReplIndex[1]:]))
+func (o *Output) style(style func(string) string, s string) string {
+	if !o.color || s == "" {
+		return s
+	}
+	return style(s)
+}
 
-	o.print(info.LinesAfterMatch)
+// styleLines styles every line of s on its own, so the line breaks and the
+// gutter are not styled.
+func (o *Output) styleLines(style func(string) string, s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = o.style(style, line)
+	}
+	return strings.Join(lines, "\n")
 }
 
 func (o *Output) print(s string) {
+	if o.json {
+		return
+	}
 	fmt.Fprint(o.stdout, s)
 }
 
 func (o *Output) printf(format string, a ...interface{}) {
+	if o.json {
+		return
+	}
 	fmt.Fprintf(o.stdout, format, a...)
 }
 
+// printErrorf prints to stderr as is, e.g. the usage after an invalid
+// argument.
+func (o *Output) printErrorf(format string, a ...interface{}) {
+	fmt.Fprintf(o.stderr, format, a...)
+}
+
 func (o *Output) printHeader(format string, a ...interface{}) {
-	fmt.Fprintf(o.stdout, styleHeader("\n "+format)+"\n", a...)
+	if o.json {
+		return
+	}
+	fmt.Fprintf(o.stdout, o.style(styleHeader, "\n "+format)+"\n", a...)
 }
 
 func (o *Output) reportVerbose(format string, a ...interface{}) {
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestUseColor(t *testing.T) {
+	// /dev/null is a character device, but no terminal
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer devNull.Close()
+	// the controlling terminal, if there is one
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err == nil {
+		defer tty.Close()
+	}
+
+	setenv(t, "NO_COLOR", "")
+
+	cases := []struct {
+		mode     string
+		noColor  string
+		terminal bool
+		expected bool
+	}{
+		{ColorAuto, "", true, true},
+		{ColorAuto, "", false, false},
+		{ColorAuto, "1", true, false},
+		{ColorAlways, "", false, true},
+		{ColorAlways, "1", false, true},
+		{ColorNever, "", true, false},
+	}
+	for index, c := range cases {
+		os.Setenv("NO_COLOR", c.noColor)
+		var w io.Writer = &bytes.Buffer{}
+		if c.terminal {
+			if tty == nil {
+				continue
+			}
+			w = tty
+		}
+		if actual := useColor(c.mode, w); actual != c.expected {
+			t.Errorf(
+				"Case: #%d - mode: %s, NO_COLOR: %q, terminal: %v, expected: %v, actual: %v",
+				index, c.mode, c.noColor, c.terminal, c.expected, actual)
+		}
+	}
+
+	os.Setenv("NO_COLOR", "")
+	if useColor(ColorAuto, devNull) {
+		t.Errorf("Expected no color for %s", os.DevNull)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jessevdk/go-flags"
+)
+
+const (
+	PlanWrite  = "write"
+	PlanRename = "rename"
+	// PlanRemove removes a directory, which was emptied by a merge
+	PlanRemove = "remove"
+)
+
+var ErrChangedSincePlan = errors.New("changed since the plan")
+
+type planOptions struct {
+	Output string `short:"o" long:"output" description:"Write the plan to FILE" value-name:"FILE" required:"yes"`
+}
+
+type applyOptions struct {
+	DryRun        bool   `short:"d" long:"dry-run"     description:"Do not change anything"`
+	Verbose       bool   `short:"v" long:"verbose"     description:"Show verbose debug information"`
+	PreserveMtime bool   `long:"preserve-mtime"        description:"Keep the modification time of changed files"`
+	HardLinks     string `long:"hard-links"            description:"Skip files with multiple hard links or write them in place" choice:"skip" choice:"in-place" default:"skip"`
+	Args          struct {
+		Plan string `positional-arg-name:"plan" description:"Plan written by the plan command" required:"yes"`
+	} `positional-args:"yes"`
+}
+
+// Plan records the changes of a dry run, so they can be reviewed and applied
+// later. Paths are relative to the root directory.
+type Plan struct {
+	Time    time.Time     `json:"time"`
+	Args    []string      `json:"args"`
+	Changes []*PlanChange `json:"changes"`
+
+	rootDirectory string
+}
+
+type PlanChange struct {
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// NewPath is the target of a rename
+	NewPath string `json:"newPath,omitempty"`
+	// OriginalHash is the sha256 of the content the write was planned for
+	OriginalHash string `json:"originalHash,omitempty"`
+	// Content is the new content of a write, it is base64 encoded in Base64
+	// instead if it is not valid UTF-8 (e.g. UTF-16)
+	Content *string `json:"content,omitempty"`
+	Base64  []byte  `json:"base64,omitempty"`
+	// Mode is the permission of a removed directory
+	Mode os.FileMode `json:"mode,omitempty"`
+}
+
+func NewPlan(rootDirectory string, args []string) *Plan {
+	return &Plan{
+		Time:          time.Now(),
+		Args:          args,
+		Changes:       []*PlanChange{},
+		rootDirectory: rootDirectory,
+	}
+}
+
+func LoadPlan(rootDirectory, path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	plan := &Plan{rootDirectory: rootDirectory}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return plan, nil
+}
+
+func (p *Plan) recordWrite(path string, original, content []byte) {
+	change := &PlanChange{
+		Type:         PlanWrite,
+		Path:         p.relativePath(path),
+		OriginalHash: contentHash(original),
+	}
+	if utf8.Valid(content) {
+		text := string(content)
+		change.Content = &text
+	} else {
+		change.Base64 = content
+	}
+	p.Changes = append(p.Changes, change)
+}
+
+// recordMove records a move of a rename, which is a rename or the removal
+// of a merged directory.
+func (p *Plan) recordMove(move renameMove) {
+	change := &PlanChange{Type: PlanRemove, Path: p.relativePath(move.Path), Mode: move.Mode}
+	if move.NewPath != "" {
+		change.Type = PlanRename
+		change.NewPath = p.relativePath(move.NewPath)
+	}
+	p.Changes = append(p.Changes, change)
+}
+
+func (p *Plan) save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func (p *Plan) relativePath(path string) string {
+	if rel, err := filepath.Rel(p.rootDirectory, path); err == nil {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+func (p *Plan) absolutePath(path string) string {
+	return filepath.Join(p.rootDirectory, filepath.FromSlash(path))
+}
+
+// clean cleans the paths of the change, it fails if a path is outside of
+// the root directory.
+func (c *PlanChange) clean() error {
+	for _, p := range []*string{&c.Path, &c.NewPath} {
+		if *p == "" {
+			continue
+		}
+		cleaned := filepath.Clean(filepath.FromSlash(*p))
+		if filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" || cleaned == ".." ||
+			strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside of the root directory", *p)
+		}
+		*p = filepath.ToSlash(cleaned)
+	}
+	return nil
+}
+
+func (c *PlanChange) content() []byte {
+	if c.Content != nil {
+		return []byte(*c.Content)
+	}
+	return c.Base64
+}
+
+// planSub runs a search and replace without changing anything and writes
+// its changes to a plan, which is applied later by applySub.
+func planSub(workingDir string, output *Output, stdin io.Reader, args []string) int {
+	planOpts := &planOptions{}
+	opts := &options{}
+	parser := flags.NewNamedParser("search-and-replace plan", flags.PassDoubleDash|flags.HelpFlag)
+	if _, err := parser.AddGroup("Plan Options", "", planOpts); err != nil {
+		panic(err)
+	}
+	if _, err := parser.AddGroup("Application Options", "", opts); err != nil {
+		panic(err)
+	}
+	if _, err := parser.ParseArgs(args); err != nil {
+		return reportParserError(output, parser, err)
+	}
+	if exitCode, ok := checkOptions(output, parser, opts); !ok {
+		return exitCode
+	}
+	opts.DryRun = true
+
+	path := planOpts.Output
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+	// the plan itself is not searched, it is overwritten anyway
+	excludeFile(workingDir, opts, path)
+
+	program, exitCode := newProgram(workingDir, output, stdin, opts, args)
+	if program == nil {
+		return exitCode
+	}
+	program.Plan = NewPlan(workingDir, args)
+	exitCode = program.Execute()
+	if exitCode == ExitError {
+		output.reportError("Plan not written, because of errors")
+		return exitCode
+	}
+
+	if err := program.Plan.save(path); err != nil {
+		output.reportError("Could not write plan: %s (%s)", planOpts.Output, err)
+		return ExitError
+	}
+	output.reportInfo(
+		"Plan: %s (apply with: search-and-replace apply %s)",
+		planOpts.Output, planOpts.Output)
+	return exitCode
+}
+
+// applySub applies the changes of a plan, files which were changed since the
+// plan was made are reported and left alone. Like a search and replace the
+// changes are recorded in a journal, so they can be undone.
+func applySub(workingDir string, output *Output, stdin io.Reader, args []string) int {
+	opts := &applyOptions{}
+	if exitCode, ok := parseCommandOptions(output, "apply", opts, args); !ok {
+		return exitCode
+	}
+	output.verbose = opts.Verbose
+
+	path := opts.Args.Plan
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+	plan, err := LoadPlan(workingDir, path)
+	if err != nil {
+		output.reportError("Could not load plan: %s", err)
+		return ExitError
+	}
+	output.reportVerbose("Plan: %s %v", opts.Args.Plan, plan.Args)
+
+	writer := &FileWriter{
+		PreserveMtime: opts.PreserveMtime,
+		HardLinks:     opts.HardLinks,
+	}
+	var journal *Journal
+	if !opts.DryRun {
+		journal = NewJournal(workingDir, append([]string{"apply"}, args...))
+	}
+
+	// files which could not be written are not renamed
+	failed := map[string]bool{}
+	for _, change := range plan.Changes {
+		if err := change.clean(); err != nil {
+			output.reportError("Invalid change: %s %s (%s)", change.Type, change.Path, err)
+			continue
+		}
+		path := plan.absolutePath(change.Path)
+		switch change.Type {
+		case PlanWrite:
+			if err := applyWrite(path, change, writer, journal); err != nil {
+				output.reportError("Could not write: %s (%s)", change.Path, err)
+				failed[change.Path] = true
+				continue
+			}
+			output.reportInfo("Write: %s", change.Path)
+		case PlanRename:
+			if failed[change.Path] {
+				continue
+			}
+			newPath := plan.absolutePath(change.NewPath)
+			if err := applyRename(path, newPath, opts.DryRun); err != nil {
+				output.reportError("Could not move: %s (%s)", change.Path, err)
+				continue
+			}
+			output.reportInfo("Rename: %s", change.NewPath)
+			if journal != nil {
+				if err := journal.recordMove(renameMove{Path: path, NewPath: newPath}); err != nil {
+					output.reportError("Could not write journal: %s", err)
+				}
+			}
+		case PlanRemove:
+			if !opts.DryRun {
+				// only an empty directory is removed
+				if err := os.Remove(path); err != nil {
+					output.reportError("Could not remove: %s (%s)", change.Path, err)
+					continue
+				}
+			}
+			output.reportVerbose("Remove: %s", change.Path)
+			if journal != nil {
+				if err := journal.recordMove(renameMove{Path: path, Mode: change.Mode}); err != nil {
+					output.reportError("Could not write journal: %s", err)
+				}
+			}
+		default:
+			output.reportError("Unknown change: %s %s", change.Type, change.Path)
+		}
+	}
+
+	if journal != nil {
+		if err := journal.close(); err != nil {
+			output.reportError("Could not write journal: %s", err)
+		}
+	}
+	if journal != nil && len(journal.Entries) > 0 {
+		output.reportInfo(
+			"Journal: %s (undo with: search-and-replace undo %s)",
+			journal.ID, journal.ID)
+	}
+	if output.errors() > 0 {
+		return ExitError
+	}
+	return ExitOK
+}
+
+// applyWrite writes the planned content, unless the file was changed since
+// the plan was made. The write is journaled before, the journal is nil in a
+// dry run.
+func applyWrite(path string, change *PlanChange, writer *FileWriter, journal *Journal) error {
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if contentHash(original) != change.OriginalHash {
+		return ErrChangedSincePlan
+	}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if journal == nil {
+		return nil
+	}
+	entry, err := journal.recordWrite(path, original, change.content())
+	if err != nil {
+		return fmt.Errorf("could not write journal: %s", err)
+	}
+	if err := writer.Write(path, change.content(), fileInfo); err != nil {
+		return err
+	}
+	// the write is done, a pending entry of the written file is undone too
+	journal.recordDone(entry)
+	return nil
+}
+
+// applyRename moves path to newPath, unless path is missing or newPath
+// exists already.
+func applyRename(path, newPath string, dryRun bool) error {
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("%s already exists", filepath.Base(newPath))
+	}
+	if dryRun {
+		return nil
+	}
+	return os.Rename(path, newPath)
+}
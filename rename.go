@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Policies of the --on-conflict option, they decide what happens if the new
+// name of a renamed file or directory exists already.
+const (
+	ConflictAbort  = "abort"
+	ConflictSkip   = "skip"
+	ConflictMerge  = "merge"
+	ConflictSuffix = "suffix"
+)
+
+var conflictPolicies = []string{ConflictAbort, ConflictSkip, ConflictMerge, ConflictSuffix}
+
+func isConflictPolicy(name string) bool {
+	for _, policy := range conflictPolicies {
+		if name == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// RenameConflict is returned if a rename would overwrite Existing, which is
+// the new path or a path inside of it when directories are merged.
+type RenameConflict struct {
+	Existing string
+}
+
+func (c *RenameConflict) Error() string {
+	return fmt.Sprintf("%s already exists", c.Existing)
+}
+
+// renameMove moves Path to NewPath, or removes the empty directory Path if
+// NewPath is empty. Mode is the permission of a removed directory, so it can
+// be created again.
+type renameMove struct {
+	Path, NewPath string
+	Mode          os.FileMode
+}
+
+// renameTree is the tree as seen by the renames of a run. A simulated tree
+// records the moves instead of making them, so a dry run finds the same
+// conflicts as a real run.
+type renameTree struct {
+	simulate bool
+	root     *renameNode
+}
+
+// renameNode holds the record of a path of a simulated tree and the nodes of
+// the paths inside of it. A path without record is located like its nearest
+// parent with record.
+type renameNode struct {
+	// diskPath is where a moved path is located on disk
+	diskPath string
+	// removed paths do not exist anymore
+	removed  bool
+	children map[string]*renameNode
+}
+
+func newRenameTree(simulate bool) *renameTree {
+	return &renameTree{simulate: simulate, root: newRenameNode()}
+}
+
+func newRenameNode() *renameNode {
+	return &renameNode{children: map[string]*renameNode{}}
+}
+
+// resolve returns the moves to rename path to newPath, a conflict with an
+// existing path is resolved by the policy or returned as *RenameConflict.
+func (t *renameTree) resolve(path, newPath, policy string) ([]renameMove, error) {
+	fileInfo, err := t.lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := t.lstat(newPath)
+	// a file system, which ignores the case, finds the path itself when only
+	// the case of the name changes
+	if err != nil || os.SameFile(fileInfo, existing) {
+		return []renameMove{{Path: path, NewPath: newPath}}, nil
+	}
+	switch {
+	case policy == ConflictSuffix:
+		return []renameMove{{Path: path, NewPath: t.suffixed(newPath, fileInfo.IsDir())}}, nil
+	case policy == ConflictMerge && fileInfo.IsDir() && existing.IsDir():
+		return t.merge(path, newPath, fileInfo.Mode())
+	}
+	return nil, &RenameConflict{Existing: newPath}
+}
+
+// merge returns the moves of the entries of the directory path into the
+// existing directory newPath, directories which exist in both are merged
+// too. Path, which has the given mode, is removed at last.
+func (t *renameTree) merge(path, newPath string, mode os.FileMode) ([]renameMove, error) {
+	names, err := t.names(path)
+	if err != nil {
+		return nil, err
+	}
+	moves := []renameMove{}
+	for _, name := range names {
+		from, to := filepath.Join(path, name), filepath.Join(newPath, name)
+		existing, err := t.lstat(to)
+		if err != nil {
+			moves = append(moves, renameMove{Path: from, NewPath: to})
+			continue
+		}
+		fileInfo, err := t.lstat(from)
+		if err != nil {
+			return nil, err
+		}
+		if !fileInfo.IsDir() || !existing.IsDir() {
+			return nil, &RenameConflict{Existing: to}
+		}
+		merged, err := t.merge(from, to, fileInfo.Mode())
+		if err != nil {
+			return nil, err
+		}
+		moves = append(moves, merged...)
+	}
+	return append(moves, renameMove{Path: path, Mode: mode.Perm()}), nil
+}
+
+// suffixed returns the first free path of path with the suffix -1, -2...
+// before the extension of a file.
+func (t *renameTree) suffixed(path string, isDir bool) string {
+	ext := filepath.Ext(path)
+	if isDir || ext == filepath.Base(path) {
+		ext = ""
+	}
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), n, ext)
+		if _, err := t.lstat(candidate); err != nil {
+			return candidate
+		}
+	}
+}
+
+// apply records a move of a simulated tree.
+func (t *renameTree) apply(move renameMove) {
+	if !t.simulate {
+		return
+	}
+	if move.NewPath == "" {
+		t.detach(move.Path)
+		t.node(move.Path).removed = true
+		return
+	}
+	diskPath, _ := t.diskPath(move.Path)
+	// the records inside a moved directory move along
+	node := t.detach(move.Path)
+	if node == nil {
+		node = newRenameNode()
+	}
+	node.diskPath = diskPath
+	t.detach(move.NewPath)
+	t.node(filepath.Dir(move.NewPath)).children[filepath.Base(move.NewPath)] = node
+	t.node(move.Path).removed = true
+}
+
+// node returns the node of the path, it is created if it does not exist.
+func (t *renameTree) node(path string) *renameNode {
+	node := t.root
+	for _, name := range splitPath(path) {
+		child, ok := node.children[name]
+		if !ok {
+			child = newRenameNode()
+			node.children[name] = child
+		}
+		node = child
+	}
+	return node
+}
+
+// lookup returns the node of the path, it is nil if there are no records of
+// the path.
+func (t *renameTree) lookup(path string) *renameNode {
+	node := t.root
+	for _, name := range splitPath(path) {
+		if node = node.children[name]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// detach drops the node of the path and returns it.
+func (t *renameTree) detach(path string) *renameNode {
+	parent := t.lookup(filepath.Dir(path))
+	if parent == nil {
+		return nil
+	}
+	name := filepath.Base(path)
+	node := parent.children[name]
+	delete(parent.children, name)
+	return node
+}
+
+// diskPath returns where path is located on disk, it is false if path was
+// moved away or removed.
+func (t *renameTree) diskPath(path string) (string, bool) {
+	diskPath, ok := path, true
+	names := splitPath(path)
+	node := t.root
+	for i, name := range names {
+		if node = node.children[name]; node == nil {
+			break
+		}
+		switch {
+		case node.removed:
+			diskPath, ok = "", false
+		case node.diskPath != "":
+			diskPath, ok = filepath.Join(append([]string{node.diskPath}, names[i+1:]...)...), true
+		}
+	}
+	return diskPath, ok
+}
+
+func (t *renameTree) lstat(path string) (os.FileInfo, error) {
+	diskPath, ok := t.diskPath(path)
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return os.Lstat(diskPath)
+}
+
+// names returns the sorted names of the entries of the directory.
+func (t *renameTree) names(dir string) ([]string, error) {
+	diskDir, _ := t.diskPath(dir)
+	entries, err := ioutil.ReadDir(diskDir)
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, entry := range entries {
+		if _, err := t.lstat(filepath.Join(dir, entry.Name())); err == nil {
+			found[entry.Name()] = true
+		}
+	}
+	if node := t.lookup(dir); node != nil {
+		for name, child := range node.children {
+			if child.diskPath != "" {
+				found[name] = true
+			}
+		}
+	}
+	names := []string{}
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// splitPath splits a path into the names of its parent directories and its
+// base name, the root directory is the first name.
+func splitPath(path string) []string {
+	names := strings.Split(filepath.Clean(path), string(filepath.Separator))
+	if len(names) > 1 && names[len(names)-1] == "" {
+		// the root directory itself
+		names = names[:len(names)-1]
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenameTreeResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range []string{
+		"foo.txt", "bar.txt", "bar-1.txt", ".foo", ".bar",
+		"foo_dir/a.txt", "foo_dir/sub/x.txt", "bar_dir/b.txt", "bar_dir/sub/y.txt",
+		"foo_conflict/b.txt",
+	} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, path), []byte{}, 0644)
+	}
+	// the modes of merged directories are kept, so they can be created again
+	os.Chmod(filepath.Join(dir, "foo_dir"), 0750)
+	os.Chmod(filepath.Join(dir, "foo_dir/sub"), 0700)
+
+	cases := []struct {
+		path, newPath, policy string
+		expected              []renameMove
+		conflict              string
+	}{
+		{"foo.txt", "qux.txt", ConflictAbort, []renameMove{{Path: "foo.txt", NewPath: "qux.txt"}}, ""},
+		{"foo.txt", "bar.txt", ConflictAbort, nil, "bar.txt"},
+		{"foo.txt", "bar.txt", ConflictSkip, nil, "bar.txt"},
+		{"foo.txt", "bar.txt", ConflictMerge, nil, "bar.txt"},
+		{"foo.txt", "bar.txt", ConflictSuffix, []renameMove{{Path: "foo.txt", NewPath: "bar-2.txt"}}, ""},
+		{".foo", ".bar", ConflictSuffix, []renameMove{{Path: ".foo", NewPath: ".bar-1"}}, ""},
+		{"foo_dir", "bar_dir", ConflictSuffix, []renameMove{{Path: "foo_dir", NewPath: "bar_dir-1"}}, ""},
+		{"foo_dir", "bar_dir", ConflictMerge, []renameMove{
+			{Path: "foo_dir/a.txt", NewPath: "bar_dir/a.txt"},
+			{Path: "foo_dir/sub/x.txt", NewPath: "bar_dir/sub/x.txt"},
+			{Path: "foo_dir/sub", Mode: 0700},
+			{Path: "foo_dir", Mode: 0750},
+		}, ""},
+		{"foo_conflict", "bar_dir", ConflictMerge, nil, "bar_dir/b.txt"},
+	}
+	for index, c := range cases {
+		moves, err := newRenameTree(true).resolve(
+			filepath.Join(dir, c.path), filepath.Join(dir, c.newPath), c.policy)
+		if c.conflict != "" {
+			conflict, ok := err.(*RenameConflict)
+			if !ok || conflict.Existing != filepath.Join(dir, c.conflict) {
+				t.Errorf("Case: #%d - expected conflict: %s, actual: %v", index, c.conflict, err)
+			}
+			continue
+		}
+		for i := range moves {
+			moves[i].Path, _ = filepath.Rel(dir, moves[i].Path)
+			if moves[i].NewPath != "" {
+				moves[i].NewPath, _ = filepath.Rel(dir, moves[i].NewPath)
+			}
+		}
+		if err != nil || !reflect.DeepEqual(moves, c.expected) {
+			t.Errorf("Case: #%d - expected: %v, actual: %v (%v)", index, c.expected, moves, err)
+		}
+	}
+}
+
+func TestRenameTreeSimulation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"foo.txt", "bar.txt", "foo_dir/a.txt", "bar_dir/b.txt"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, path), []byte{}, 0644)
+	}
+	path := func(p string) string {
+		return filepath.Join(dir, p)
+	}
+	tree := newRenameTree(true)
+	resolve := func(p, newPath, policy string) []renameMove {
+		moves, err := tree.resolve(path(p), path(newPath), policy)
+		if err != nil {
+			t.Fatalf("%s to %s: %s", p, newPath, err)
+		}
+		for _, move := range moves {
+			tree.apply(move)
+		}
+		return moves
+	}
+
+	// the new path of a previous rename is taken, the old one is free
+	resolve("foo.txt", "qux.txt", ConflictAbort)
+	if _, err := tree.resolve(path("bar.txt"), path("qux.txt"), ConflictAbort); err == nil {
+		t.Errorf("Expected conflict with renamed file")
+	}
+	resolve("bar.txt", "foo.txt", ConflictAbort)
+
+	// a merge moves renamed entries and moves with the directory
+	resolve("foo_dir/a.txt", "foo_dir/c.txt", ConflictAbort)
+	resolve("foo_dir", "bar_dir", ConflictMerge)
+	resolve("bar_dir", "baz_dir", ConflictAbort)
+	if names, _ := tree.names(path("baz_dir")); !reflect.DeepEqual(names, []string{"b.txt", "c.txt"}) {
+		t.Errorf("Unexpected names: %v", names)
+	}
+	if diskPath, _ := tree.diskPath(path("baz_dir/c.txt")); diskPath != path("foo_dir/a.txt") {
+		t.Errorf("Unexpected disk path: %s", diskPath)
+	}
+	for _, p := range []string{"foo_dir", "bar_dir", "bar.txt"} {
+		if _, err := tree.lstat(path(p)); err == nil {
+			t.Errorf("Expected %s to be moved", p)
+		}
+	}
+
+	// nothing was changed on disk
+	for _, p := range []string{"foo.txt", "bar.txt", "foo_dir/a.txt", "bar_dir/b.txt"} {
+		if _, err := os.Lstat(path(p)); err != nil {
+			t.Errorf("Changed on disk: %s", err)
+		}
+	}
+}
@@ -1,59 +1,383 @@
 package main
 
-import "regexp"
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
 
 const LineFeed = 10
+
+// ContextLineCount is the default number of lines before and after a match
+// in the ReplacementInfo.
 const ContextLineCount = 3
 
+// ContextByteLimit caps the context before and after a match in the
+// ReplacementInfo, so long lines (e.g. of minified files) do not make every
+// match cost the length of its line.
+const ContextByteLimit = 1024
+
+// Context is the number of lines before and after a match in the
+// ReplacementInfo.
+type Context struct {
+	Before, After int
+}
+
 type Replace struct {
 	Search, Replace string
 	Regexp          bool
+	// PreserveCase matches the search string in all naming conventions and
+	// replaces it with the replace string in the same convention
+	PreserveCase bool
+	// IgnoreCase matches case insensitive, SmartCase does the same unless
+	// the search string contains upper case characters
+	IgnoreCase, SmartCase bool
+	// Word matches only whole words
+	Word bool
+	// Context defaults to ContextLineCount lines before and after a match
+	Context *Context
+
+	// compiled once and shared by all goroutines executing the replace
+	once     sync.Once
+	err      error
+	literal  bool
+	rgx      *regexp.Regexp
+	variants map[string]string
+	// in word mode the search string enclosed by non-word characters, at
+	// the start of the input and behind a non-word character
+	wordStart, wordNext *regexp.Regexp
 }
 
+// Execute replaces all matches in the input, the callback decides about
+// every match. The replace string is expanded ($1, ${name}) only if the
+// search string is a regular expression.
 func (r *Replace) Execute(in string, callback ReplaceCallback) string {
-	result := ""
-	remainder := in
-	search := r.Search
-	if !r.Regexp {
-		search = regexp.QuoteMeta(search)
+	if err := r.compile(); err != nil {
+		panic(err)
 	}
-	rgx := regexp.MustCompile(search)
 
-	var match []int
-	replacement := []byte{}
+	context := Context{ContextLineCount, ContextLineCount}
+	if r.Context != nil {
+		context = *r.Context
+	}
 
-	replacementInfo := func() ReplacementInfo {
-		content := result + remainder
-		matchOffset := len(result)
-		matchStart := match[0] + matchOffset
-		matchEnd := match[1] + matchOffset
-		return newReplacementInfo(content, string(replacement), matchStart, matchEnd)
+	var result strings.Builder
+	result.Grow(len(in))
+	// in[offset:] is not copied to the result yet
+	offset := 0
+
+	// the position is counted from the previous match on
+	lineNumber, lineStart, positionOffset := 1, 0, 0
+
+	replacementInfo := func(match []int, replacement string) ReplacementInfo {
+		start, end := match[0], match[1]
+
+		// the context contains the previous replacements, it is taken
+		// from the end of the result, so it costs only the context lines
+		before := tailLines(result.String(), context.Before)
+		after := headLines(in[end:], context.After)
+		content := before + in[start:end] + after
+		info := newReplacementInfo(content, replacement, len(before), len(before)+end-start, context)
+
+		// position in the input
+		skipped := in[positionOffset:start]
+		if lines := strings.Count(skipped, "\n"); lines > 0 {
+			lineNumber += lines
+			lineStart = positionOffset + strings.LastIndexByte(skipped, LineFeed) + 1
+		}
+		positionOffset = start
+		info.LineNumber = lineNumber
+		info.Column = start - lineStart + 1
+		info.MatchIndex = []int{start, end}
+		return info
 	}
 
+	for _, match := range r.matches(in) {
+		start, end := match[0], match[1]
+
+		replacement := r.replacement(in, match)
+		result.WriteString(in[offset:start])
+		if callback == nil {
+			result.WriteString(replacement)
+		} else if info := replacementInfo(match, replacement); callback(&info) {
+			result.WriteString(info.Repl)
+		} else {
+			result.WriteString(in[start:end])
+		}
+		offset = end
+	}
+	result.WriteString(in[offset:])
+	return result.String()
+}
+
+// matches returns the indexes of all matches in the input like
+// regexp.FindAllStringSubmatchIndex, the regular expression is matched
+// against the whole input, so anchors and boundaries work like in
+// regexp.ReplaceAllString. In word mode only whole words match.
+func (r *Replace) matches(in string) [][]int {
+	if !r.literal {
+		if !r.Word {
+			return r.rgx.FindAllStringSubmatchIndex(in, -1)
+		}
+		return r.wordMatches(in)
+	}
+
+	matches := [][]int{}
+	offset := 0
 	for {
-		match = rgx.FindStringSubmatchIndex(remainder)
+		index := strings.Index(in[offset:], r.Search)
+		if index < 0 {
+			return matches
+		}
+		match := []int{offset + index, offset + index + len(r.Search)}
+		if r.Word && !isWordMatch(in, match) {
+			// continue behind the first rune of the match
+			_, size := utf8.DecodeRuneInString(in[match[0]:])
+			offset = match[0] + size
+			continue
+		}
+		matches = append(matches, match)
+		offset = match[1]
+	}
+}
+
+// wordMatches returns the whole word matches of the regular expression. The
+// enclosing non-word characters are part of the regular expression, so a
+// match followed by a word character does not hide a longer alternative
+// (foo|foobar).
+func (r *Replace) wordMatches(in string) [][]int {
+	matches := [][]int{}
+	// the next match starts at in[next:] or later
+	next := 0
+	for next <= len(in) {
+		match := r.findWord(in, next)
 		if match == nil {
-			result += remainder
 			break
 		}
+		// like in regexp, an empty match is dropped next to the previous match
+		empty := match[0] == match[1]
+		if !empty || len(matches) == 0 || matches[len(matches)-1][1] != match[0] {
+			matches = append(matches, match)
+		}
+		next = match[1]
+		if empty {
+			if next == len(in) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(in[next:])
+			next += size
+		}
+	}
+	return matches
+}
+
+// findWord returns the first whole word match at in[next:] or later. The
+// input is sliced at the character in front of next, so anchors and
+// boundaries see the same context as in the whole input.
+func (r *Replace) findWord(in string, next int) []int {
+	if next == 0 {
+		if match := r.wordStart.FindStringSubmatchIndex(in); match != nil {
+			return wordMatch(match, 0)
+		}
+	}
+	_, size := utf8.DecodeLastRuneInString(in[:next])
+	start := next - size
+	match := r.wordNext.FindStringSubmatchIndex(in[start:])
+	if match == nil {
+		return nil
+	}
+	// skip the non-word character in front of the match
+	_, size = utf8.DecodeRuneInString(in[start+match[0]:])
+	match[0] += size
+	return wordMatch(match, start)
+}
+
+// wordMatch converts a match of Replace.wordStart or wordNext in in[offset:]
+// to a match of the search string in the input.
+func wordMatch(match []int, offset int) []int {
+	// the last group marks the end of the search string
+	match[1] = match[len(match)-2]
+	match = match[:len(match)-2]
+	for i := range match {
+		if match[i] >= 0 {
+			match[i] += offset
+		}
+	}
+	return match
+}
 
-		replacement = []byte{}
-		replacement = rgx.ExpandString(replacement, r.Replace, in, match)
+func (r *Replace) replacement(in string, match []int) string {
+	switch {
+	case r.variants != nil:
+		return r.variants[in[match[0]:match[1]]]
+	case r.Regexp:
+		return lineBreaksLike(string(r.rgx.ExpandString(nil, r.Replace, in, match)), in[match[0]:match[1]])
+	default:
+		return lineBreaksLike(r.Replace, in[match[0]:match[1]])
+	}
+}
 
-		if callback != nil && !callback(replacementInfo()) {
-			result += remainder[0:match[1]]
-		} else {
-			result += remainder[0:match[0]] + string(replacement)
+// lineBreaksLike converts the line breaks of the replacement to the ones of
+// a match spanning several lines.
+func lineBreaksLike(replacement, match string) string {
+	if !strings.Contains(match, "\n") {
+		return replacement
+	}
+	replacement = strings.Replace(replacement, "\r\n", "\n", -1)
+	if strings.Contains(match, "\r\n") {
+		replacement = strings.Replace(replacement, "\n", "\r\n", -1)
+	}
+	return replacement
+}
+
+// compile checks the options and compiles the search string, a literal
+// search string is searched without a regular expression.
+func (r *Replace) compile() error {
+	r.once.Do(func() {
+		if r.PreserveCase && r.Regexp {
+			r.err = errors.New("preserve case can not be combined with regexp")
+			return
+		}
+		if r.PreserveCase && (r.IgnoreCase || r.SmartCase) {
+			r.err = errors.New("preserve case can not be combined with ignore case")
+			return
+		}
+		if r.PreserveCase {
+			r.variants = caseVariants(r.Search, r.Replace)
 		}
+		if !r.Regexp && !r.PreserveCase && !r.ignoreCase() && r.Search != "" &&
+			!strings.Contains(r.Search, "\n") {
+			r.literal = true
+			return
+		}
+		r.rgx, r.err = regexp.Compile(r.pattern())
+		if r.err == nil && r.Word {
+			const nonWord = `[^_\p{L}\p{Nd}\p{M}]`
+			enclosed := "(?:" + r.pattern() + ")()(?:" + nonWord + `|\z)`
+			r.wordStart = regexp.MustCompile(`\A` + enclosed)
+			r.wordNext = regexp.MustCompile(nonWord + enclosed)
+		}
+	})
+	return r.err
+}
 
-		remainder = remainder[match[1]:]
+// pattern returns the regular expression of the search string, its line
+// breaks match LF and CRLF.
+func (r *Replace) pattern() string {
+	pattern := r.Search
+	if r.PreserveCase {
+		pattern = caseVariantsPattern(caseVariants(r.Search, r.Replace))
+	} else {
+		if !r.Regexp {
+			pattern = regexp.QuoteMeta(r.Search)
+		}
+		pattern = lineBreakPattern(pattern)
+	}
+	if r.ignoreCase() {
+		pattern = "(?i)" + pattern
 	}
-	return result
+	return pattern
 }
 
-type ReplaceCallback func(info ReplacementInfo) bool
+// lineBreakPattern makes the line breaks (LF or CRLF) of a regular
+// expression match LF and CRLF. Line breaks in character classes like [^\n]
+// are kept as they are.
+func lineBreakPattern(pattern string) string {
+	var result strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			result.WriteString(pattern[i : i+2])
+			i++
+			continue
+		case inClass:
+			// a named class like [:alpha:] does not end the class
+			if strings.HasPrefix(pattern[i:], "[:") {
+				if end := strings.Index(pattern[i+2:], ":]"); end >= 0 {
+					result.WriteString(pattern[i : i+end+4])
+					i += end + 3
+					continue
+				}
+			}
+			inClass = c != ']'
+		case c == '[':
+			// a ] right after the opening bracket (and ^) is a literal
+			end := i + 1
+			if end < len(pattern) && pattern[end] == '^' {
+				end++
+			}
+			if end < len(pattern) && pattern[end] == ']' {
+				end++
+			}
+			result.WriteString(pattern[i:end])
+			i = end - 1
+			inClass = true
+			continue
+		case strings.HasPrefix(pattern[i:], "\r\n"):
+			result.WriteString(`(?:\r?\n)`)
+			i++
+			continue
+		case c == '\n':
+			result.WriteString(`(?:\r?\n)`)
+			continue
+		}
+		result.WriteByte(c)
+	}
+	return result.String()
+}
+
+func (r *Replace) ignoreCase() bool {
+	if r.SmartCase {
+		return !hasUpperCase(r.Search, r.Regexp)
+	}
+	return r.IgnoreCase
+}
+
+// hasUpperCase reports whether s contains upper case characters, escape
+// sequences like \S or \W of regular expressions are not taken into account.
+func hasUpperCase(s string, isRegexp bool) bool {
+	escaped := false
+	for _, r := range s {
+		if isRegexp && !escaped && r == '\\' {
+			escaped = true
+			continue
+		}
+		if !escaped && unicode.IsUpper(r) {
+			return true
+		}
+		escaped = false
+	}
+	return false
+}
+
+// isWordMatch reports whether the match in content is neither preceded nor
+// followed by a word character.
+func isWordMatch(content string, match []int) bool {
+	before, _ := utf8.DecodeLastRuneInString(content[:match[0]])
+	after, _ := utf8.DecodeRuneInString(content[match[1]:])
+	return !isWordRune(before) && !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// ReplaceCallback decides whether a match is replaced, it may change the
+// replacement by setting info.Repl.
+type ReplaceCallback func(info *ReplacementInfo) bool
 
 type ReplacementInfo struct {
+	// LineNumber and Column (in bytes, both starting at 1) and MatchIndex
+	// (byte offsets) locate the match in the input
+	LineNumber int
+	Column     int
+	MatchIndex []int
+
 	LinesBeforeMatch    string
 	Match               string
 	MatchLine           string
@@ -64,9 +388,13 @@ type ReplacementInfo struct {
 	LinesAfterMatch     string
 }
 
-func newReplacementInfo(content, replacement string, matchStart, matchEnd int) ReplacementInfo {
+func newReplacementInfo(content, replacement string, matchStart, matchEnd int, context Context) ReplacementInfo {
 	lineStartIndex := findLineStartIndex(content, matchStart)
 	lineEndIndex := findLineEndIndex(content, matchEnd)
+	if matchEnd > matchStart && content[matchEnd-1] == LineFeed {
+		// the match ends with its last line
+		lineEndIndex = matchEnd - 1
+	}
 
 	matchLine := content[lineStartIndex : lineEndIndex+1]
 	lineContentBeforeMatch := matchLine[:matchStart-lineStartIndex]
@@ -83,35 +411,76 @@ func newReplacementInfo(content, replacement string, matchStart, matchEnd int) R
 	}
 
 	return ReplacementInfo{
-		LinesBeforeMatch:    linesBeforeMatch(content, lineStartIndex),
+		LinesBeforeMatch:    linesBeforeMatch(content, lineStartIndex, context.Before),
 		Match:               matchLine[matchLineMatchIndex[0]:matchLineMatchIndex[1]],
 		MatchLine:           matchLine,
 		MatchLineMatchIndex: matchLineMatchIndex,
 		Repl:                replacementLine[replacementLineReplacementIndex[0]:replacementLineReplacementIndex[1]],
 		ReplLine:            replacementLine,
 		ReplLineReplIndex:   replacementLineReplacementIndex,
-		LinesAfterMatch:     linesAfterMatch(content, lineEndIndex),
+		LinesAfterMatch:     linesAfterMatch(content, lineEndIndex, context.After),
 	}
 }
 
-func linesBeforeMatch(content string, lineStartIndex int) string {
-	from := findPreviousLinesStartIndex(content, lineStartIndex, ContextLineCount)
+func linesBeforeMatch(content string, lineStartIndex int, n int) string {
+	from := findPreviousLinesStartIndex(content, lineStartIndex, n)
 	to := lineStartIndex
 	return content[from:to]
 }
 
-func linesAfterMatch(content string, lineEndIndex int) string {
+func linesAfterMatch(content string, lineEndIndex int, n int) string {
 	if lineEndIndex == len(content)-1 {
 		return ""
 	}
 	from := lineEndIndex
-	to := findNextLinesEndIndex(content, lineEndIndex, ContextLineCount)
+	to := findNextLinesEndIndex(content, lineEndIndex, n)
 	if from < len(content)-1 {
 		from++
 	}
 	return content[from : to+1]
 }
 
+// tailLines returns the end of s, which contains the incomplete last line
+// and the n lines before it, but not more than ContextByteLimit bytes.
+func tailLines(s string, n int) string {
+	if len(s) > ContextByteLimit {
+		from := len(s) - ContextByteLimit
+		for from < len(s) && !utf8.RuneStart(s[from]) {
+			from++
+		}
+		s = s[from:]
+	}
+	index := len(s)
+	for i := 0; i <= n; i++ {
+		index = strings.LastIndexByte(s[:index], LineFeed)
+		if index < 0 {
+			return s
+		}
+	}
+	return s[index+1:]
+}
+
+// headLines returns the start of s up to the end of the first line and the
+// n lines after it, but not more than ContextByteLimit bytes.
+func headLines(s string, n int) string {
+	if len(s) > ContextByteLimit {
+		to := ContextByteLimit
+		for to > 0 && !utf8.RuneStart(s[to]) {
+			to--
+		}
+		s = s[:to]
+	}
+	index := 0
+	for i := 0; i <= n; i++ {
+		next := strings.IndexByte(s[index:], LineFeed)
+		if next < 0 {
+			return s
+		}
+		index += next + 1
+	}
+	return s[:index]
+}
+
 func findLineStartIndex(content string, fromIndex int) int {
 	index := fromIndex
 	if index <= 0 {
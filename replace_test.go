@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
 
 func TestReplace(t *testing.T) {
 	cases := []struct {
@@ -57,7 +63,7 @@ func TestReplaceCallback(t *testing.T) {
 		{true, "barbar"},
 	}
 	for _, c := range cases {
-		actual := (&Replace{Search: "foo", Replace: "bar"}).Execute("foobar", func(info ReplacementInfo) bool {
+		actual := (&Replace{Search: "foo", Replace: "bar"}).Execute("foobar", func(info *ReplacementInfo) bool {
 			return c.callbackResult
 		})
 		if actual != c.expected {
@@ -105,7 +111,7 @@ func TestReplacementInfoContextLines(t *testing.T) {
 		},
 	}
 	for index, c := range cases {
-		(&Replace{Search: "foo", Replace: "bar"}).Execute(c.content, func(info ReplacementInfo) bool {
+		(&Replace{Search: "foo", Replace: "bar"}).Execute(c.content, func(info *ReplacementInfo) bool {
 			if info.LinesBeforeMatch != c.expectedLinesBeforeMatch {
 				t.Errorf(
 					"Case: #%d - LinesBeforeMatch\n"+
@@ -124,3 +130,338 @@ func TestReplacementInfoContextLines(t *testing.T) {
 		})
 	}
 }
+
+func TestReplacementInfoContext(t *testing.T) {
+	content := "line1\nline2\nline3 foo\nline4\nline5\n"
+	cases := []struct {
+		context Context
+		before  string
+		after   string
+	}{
+		{Context{0, 0}, "", ""},
+		{Context{1, 2}, "line2\n", "line4\nline5\n"},
+		{Context{5, 5}, "line1\nline2\n", "line4\nline5\n"},
+	}
+	for index, c := range cases {
+		r := &Replace{Search: "foo", Replace: "bar", Context: &c.context}
+		r.Execute(content, func(info *ReplacementInfo) bool {
+			if info.LinesBeforeMatch != c.before || info.LinesAfterMatch != c.after {
+				t.Errorf(
+					"Case: #%d - expected: %q %q, actual: %q %q",
+					index, c.before, c.after, info.LinesBeforeMatch, info.LinesAfterMatch)
+			}
+			return true
+		})
+	}
+}
+
+func TestReplacementInfoPosition(t *testing.T) {
+	content := "foo\nbar foo\n\nbaz foo foo"
+	expected := [][3]int{
+		// line, column, start offset
+		{1, 1, 0},
+		{2, 5, 8},
+		{4, 5, 17},
+		{4, 9, 21},
+	}
+	index := 0
+	(&Replace{Search: "foo", Replace: "qux"}).Execute(content, func(info *ReplacementInfo) bool {
+		actual := [3]int{info.LineNumber, info.Column, info.MatchIndex[0]}
+		if actual != expected[index] {
+			t.Errorf("Match #%d - expected: %v, actual: %v", index+1, expected[index], actual)
+		}
+		if info.MatchIndex[1] != info.MatchIndex[0]+3 {
+			t.Errorf("Match #%d - MatchIndex: %v", index+1, info.MatchIndex)
+		}
+		index++
+		return index%2 == 0
+	})
+	if index != len(expected) {
+		t.Errorf("Expected %d matches, got %d", len(expected), index)
+	}
+}
+
+func TestReplacementInfoLongLine(t *testing.T) {
+	// the context of a match in a long line is capped
+	content := "line1\n" + strings.Repeat("ä", ContextByteLimit) + "foo" + strings.Repeat("ä", ContextByteLimit) + "\nline3\n"
+	matches := 0
+	(&Replace{Search: "foo", Replace: "bar"}).Execute(content, func(info *ReplacementInfo) bool {
+		matches++
+		if info.LineNumber != 2 || info.Column != 2*ContextByteLimit+1 {
+			t.Errorf("Unexpected position: %d:%d", info.LineNumber, info.Column)
+		}
+		if info.LinesBeforeMatch != "" || info.LinesAfterMatch != "" {
+			t.Errorf("Unexpected context: %q %q", info.LinesBeforeMatch, info.LinesAfterMatch)
+		}
+		expected := strings.Repeat("ä", ContextByteLimit/2) + "foo" + strings.Repeat("ä", ContextByteLimit/2)
+		if info.MatchLine != expected || info.Match != "foo" {
+			t.Errorf("Unexpected match line: %q", info.MatchLine)
+		}
+		return true
+	})
+	if matches != 1 {
+		t.Errorf("Expected 1 match, got %d", matches)
+	}
+}
+
+func TestReplacePreserveCase(t *testing.T) {
+	cases := []struct {
+		content, search, replace, expected string
+	}{
+		{
+			content:  "fooBar FooBar foo_bar FOO_BAR foo-bar foobar",
+			search:   "fooBar",
+			replace:  "bazQux",
+			expected: "bazQux BazQux baz_qux BAZ_QUX baz-qux foobar",
+		},
+		{
+			content:  "foo_bar_test.go",
+			search:   "foo_bar",
+			replace:  "bazQux",
+			expected: "bazQux_test.go",
+		},
+		{
+			content:  "foo Foo FOO",
+			search:   "foo",
+			replace:  "barBaz",
+			expected: "barBaz BarBaz BAR_BAZ",
+		},
+		{
+			content:  "newHTTPServer HTTPServer",
+			search:   "HTTPServer",
+			replace:  "GrpcServer",
+			expected: "newGrpcServer GrpcServer",
+		},
+	}
+	for index, c := range cases {
+		replace := Replace{Search: c.search, Replace: c.replace, PreserveCase: true}
+		actual := replace.Execute(c.content, nil)
+		if actual != c.expected {
+			t.Errorf(
+				"Case: #%d - content: %s, search: %s, replace: %s\n"+
+					"  actual: %#v\n"+
+					"expected: %#v\n",
+				index, c.content, c.search, c.replace, actual, c.expected)
+		}
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected []string
+	}{
+		{"foo", []string{"foo"}},
+		{"fooBar", []string{"foo", "bar"}},
+		{"FooBar", []string{"foo", "bar"}},
+		{"foo_bar", []string{"foo", "bar"}},
+		{"FOO_BAR", []string{"foo", "bar"}},
+		{"foo-bar", []string{"foo", "bar"}},
+		{"foo bar", []string{"foo", "bar"}},
+		{"HTTPServer", []string{"http", "server"}},
+		{"utf8Reader", []string{"utf8", "reader"}},
+	}
+	for _, c := range cases {
+		actual := splitWords(c.in)
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("splitWords(%v) == %#v, expected %#v", c.in, actual, c.expected)
+		}
+	}
+}
+
+func TestReplaceMatchModes(t *testing.T) {
+	cases := []struct {
+		replace  *Replace
+		content  string
+		expected string
+	}{
+		{
+			&Replace{Search: "id", Replace: "key", IgnoreCase: true},
+			"id ID Id width",
+			"key key key wkeyth",
+		},
+		{
+			&Replace{Search: "id", Replace: "key", SmartCase: true},
+			"id ID",
+			"key key",
+		},
+		{
+			&Replace{Search: "Id", Replace: "Key", SmartCase: true},
+			"id Id",
+			"id Key",
+		},
+		{
+			&Replace{Search: `\w+Id`, Replace: "key", Regexp: true, SmartCase: true},
+			"userId userid",
+			"key userid",
+		},
+		{
+			&Replace{Search: `\Sd`, Replace: "key", Regexp: true, SmartCase: true},
+			"ID",
+			"key",
+		},
+		{
+			&Replace{Search: "id", Replace: "key", Word: true},
+			"id width identity (id) id_ ä-id über_id",
+			"key width identity (key) id_ ä-key über_id",
+		},
+		{
+			&Replace{Search: "ab", Replace: "x", Word: true},
+			"aab ab",
+			"aab x",
+		},
+		{
+			&Replace{Search: "i[dD]", Replace: "key", Regexp: true, Word: true, IgnoreCase: true},
+			"ID width Id",
+			"key width key",
+		},
+		{
+			&Replace{Search: "foo|foobar", Replace: "x", Regexp: true, Word: true},
+			"foobar foo-foobar foobarx",
+			"x x-x foobarx",
+		},
+		{
+			&Replace{Search: `(?m)^id|(\w)d$`, Replace: "key$1", Regexp: true, Word: true},
+			"id idx\nid\nxid ad",
+			"key idx\nkey\nxid keya",
+		},
+	}
+	for index, c := range cases {
+		actual := c.replace.Execute(c.content, nil)
+		if actual != c.expected {
+			t.Errorf(
+				"Case: #%d - content: %s, replace: %+v\n"+
+					"  actual: %#v\n"+
+					"expected: %#v\n",
+				index, c.content, c.replace, actual, c.expected)
+		}
+	}
+}
+
+// Regular expressions have to behave like regexp.ReplaceAllString, also if
+// the callback accepts every match.
+func TestReplaceRegexpSemantics(t *testing.T) {
+	cases := []struct {
+		search, replace, content string
+	}{
+		{`^foo`, "bar", "foo foo\nfoo"},
+		{`(?m)^foo`, "bar", "foo foo\nfoo\n foo"},
+		{`foo$`, "bar", "foo foo\nfoo"},
+		{`(?m)foo$`, "bar", "foo foo\nfoo\nfoo "},
+		{`\Afoo|foo\z`, "bar", "foofoofoo"},
+		{`\bfoo\b`, "bar", "foo foobar barfoo foo"},
+		{`\Bo`, "0", "foo oo"},
+		{`x*`, "-", "abc"},
+		{`a*`, "-", "baaac"},
+		{`(\w+)@(\w+)`, "$2 at $1", "foo@bar, baz@qux"},
+		{`(?P<first>\w)(\w*)`, "${first}_$2", "foo bar"},
+		{`(a)|b`, "[$1]", "ab"},
+		{`^`, "> ", "foo"},
+		{`(?m)^`, "> ", "foo\nbar\n"},
+		{`(?s)f.*?o`, "x", "f\no fo"},
+	}
+	for index, c := range cases {
+		expected := regexp.MustCompile(c.search).ReplaceAllString(c.content, c.replace)
+		for _, callback := range []ReplaceCallback{nil, func(info *ReplacementInfo) bool { return true }} {
+			r := &Replace{Search: c.search, Replace: c.replace, Regexp: true}
+			actual := r.Execute(c.content, callback)
+			if actual != expected {
+				t.Errorf(
+					"Case: #%d - search: %s, content: %q, callback: %v\n"+
+						"  actual: %q\n"+
+						"expected: %q\n",
+					index, c.search, c.content, callback != nil, actual, expected)
+			}
+		}
+	}
+}
+
+func TestReplaceLineBreaks(t *testing.T) {
+	cases := []struct {
+		replace  *Replace
+		content  string
+		expected string
+	}{
+		{&Replace{Search: "a\nb", Replace: "x\ny"}, "a\r\nb\r\n", "x\r\ny\r\n"},
+		{&Replace{Search: "a\nb", Replace: "x\ny"}, "a\nb\n", "x\ny\n"},
+		{&Replace{Search: "a\r\nb", Replace: "x\r\ny"}, "a\nb\n", "x\ny\n"},
+		{&Replace{Search: "a\n(b)", Replace: "$1\n", Regexp: true}, "a\r\nb", "b\r\n"},
+		{&Replace{Search: "a", Replace: "x\ny"}, "a\r\n", "x\ny\r\n"},
+		// line feeds in character classes are kept
+		{&Replace{Search: "a[^\n]*\n", Replace: "x\n", Regexp: true}, "a:b\r\na?c\n", "x\r\nx\n"},
+		{&Replace{Search: "[]\n]b", Replace: "x", Regexp: true}, "a]b\nb", "axx"},
+		{&Replace{Search: "[[:alpha:]\n]+", Replace: "x", Regexp: true}, "ab\ncd\r\n", "x\rx"},
+		{&Replace{Search: "\\[\n", Replace: "x", Regexp: true}, "[\r\n", "x"},
+	}
+	for index, c := range cases {
+		actual := c.replace.Execute(c.content, nil)
+		if actual != c.expected {
+			t.Errorf("Case: #%d - expected: %q, actual: %q", index, c.expected, actual)
+		}
+	}
+}
+
+func TestReplacementInfoMultiLine(t *testing.T) {
+	content := "line1\nold1\nold2\nline4\n"
+	r := &Replace{Search: "old1\nold2\n", Replace: "new\n"}
+	r.Execute(content, func(info *ReplacementInfo) bool {
+		actual := []string{info.LinesBeforeMatch, info.MatchLine, info.ReplLine, info.LinesAfterMatch}
+		expected := []string{"line1\n", "old1\nold2\n", "new\n", "line4\n"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected: %q, actual: %q", expected, actual)
+		}
+		return true
+	})
+}
+
+func TestReplaceLiteral(t *testing.T) {
+	cases := []struct {
+		replace  *Replace
+		content  string
+		expected string
+	}{
+		{&Replace{Search: "a.b", Replace: "$1"}, "a.b axb a.b", "$1 axb $1"},
+		{&Replace{Search: "foo", Replace: "bar"}, "foofoo", "barbar"},
+		{&Replace{Search: "x*", Replace: "-", Regexp: true}, "abc", "-a-b-c-"},
+		{&Replace{Search: "", Replace: "-"}, "ab", "-a-b-"},
+	}
+	for index, c := range cases {
+		actual := c.replace.Execute(c.content, nil)
+		if actual != c.expected {
+			t.Errorf("Case: #%d - expected: %q, actual: %q", index, c.expected, actual)
+		}
+		if c.replace.literal != (index < 2) {
+			t.Errorf("Case: #%d - literal: %v", index, c.replace.literal)
+		}
+	}
+}
+
+// The time per byte has to stay the same for growing inputs.
+func BenchmarkReplace(b *testing.B) {
+	replaces := map[string]*Replace{
+		"literal":  {Search: "foo", Replace: "bar"},
+		"regexp":   {Search: "fo+", Replace: "bar", Regexp: true},
+		"callback": {Search: "foo", Replace: "bar"},
+	}
+	for _, name := range []string{"literal", "regexp", "callback"} {
+		for _, size := range []int{1 << 20, 4 << 20, 16 << 20} {
+			var callback ReplaceCallback
+			if name == "callback" {
+				callback = func(info *ReplacementInfo) bool { return true }
+			}
+			// short lines and a single long line (e.g. a minified file)
+			for _, line := range []string{"lines", "line"} {
+				content := strings.Repeat("a foo line\n", size/11)
+				if line == "line" {
+					content = strings.Repeat("a foo line ", size/11)
+				}
+				b.Run(fmt.Sprintf("%s/%s/%dMB", name, line, size>>20), func(b *testing.B) {
+					b.SetBytes(int64(len(content)))
+					for i := 0; i < b.N; i++ {
+						replaces[name].Execute(content, callback)
+					}
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/sabhiram/go-git-ignore"
+)
+
+const (
+	ScopeBoth    = "both"
+	ScopeContent = "content"
+	ScopeNames   = "names"
+)
+
+// Rule is a single search and replace rule. Rules are either built from
+// the positional arguments or read from a rules file, which contains a
+// JSON array of rules:
+//
+//	[
+//	  {"search": "FooClient", "replace": "BarClient"},
+//	  {"search": "foo_(client|server)", "replace": "bar_$1", "regexp": true,
+//	   "scope": "content", "paths": ["*.py", "!vendor/"]}
+//	]
+type Rule struct {
+	Search  string `json:"search"`
+	Replace string `json:"replace"`
+	Regexp  bool   `json:"regexp"`
+	// PreserveCase replaces all case variants of search (see Replace)
+	PreserveCase bool `json:"preserveCase"`
+	// IgnoreCase, SmartCase and Word control matching (see Replace)
+	IgnoreCase bool `json:"ignoreCase"`
+	SmartCase  bool `json:"smartCase"`
+	Word       bool `json:"word"`
+	// Scope is one of content, names or both (default)
+	Scope string `json:"scope"`
+	// Paths restricts the rule to paths matching these gitignore style globs
+	Paths []string `json:"paths"`
+
+	replace *Replace
+	paths   *ignore.GitIgnore
+}
+
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []*Rule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for index, rule := range rules {
+		if rule.Search == "" {
+			return nil, fmt.Errorf("rule #%d: search must not be empty", index+1)
+		}
+		if rule.PreserveCase && rule.Regexp {
+			return nil, fmt.Errorf("rule #%d: preserveCase can not be combined with regexp", index+1)
+		}
+		if rule.PreserveCase && (rule.IgnoreCase || rule.SmartCase) {
+			return nil, fmt.Errorf("rule #%d: preserveCase can not be combined with ignoreCase or smartCase", index+1)
+		}
+		switch rule.Scope {
+		case "", ScopeBoth, ScopeContent, ScopeNames:
+		default:
+			return nil, fmt.Errorf("rule #%d: unknown scope: %s", index+1, rule.Scope)
+		}
+	}
+	return rules, nil
+}
+
+// compile prepares the rule for execution, it fails if the search string is
+// not a valid regular expression.
+func (r *Rule) compile() error {
+	r.replace = &Replace{
+		Search:  r.Search,
+		Replace: r.Replace,
+		Regexp:  r.Regexp,
+
+		PreserveCase: r.PreserveCase,
+		IgnoreCase:   r.IgnoreCase,
+		SmartCase:    r.SmartCase,
+		Word:         r.Word,
+	}
+	if err := r.replace.compile(); err != nil {
+		return err
+	}
+
+	paths, err := ignore.CompileIgnoreLines(r.Paths...)
+	if err != nil {
+		return err
+	}
+	r.paths = paths
+	return nil
+}
+
+// appliesTo reports whether the rule is used for the content (scope
+// ScopeContent) or the name (scope ScopeNames) of the given path, which is
+// relative to the root directory.
+func (r *Rule) appliesTo(path string, scope string) bool {
+	if r.Scope != "" && r.Scope != ScopeBoth && r.Scope != scope {
+		return false
+	}
+	if len(r.Paths) > 0 && !r.paths.MatchesPath(path) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) String() string {
+	scope := r.Scope
+	if scope == "" {
+		scope = ScopeBoth
+	}
+	return fmt.Sprintf(
+		"search: %s, replace: %s, regexp: %v, preserve-case: %v, ignore-case: %v, "+
+			"smart-case: %v, word: %v, scope: %s, paths: %v",
+		r.Search, r.Replace, r.Regexp, r.PreserveCase, r.IgnoreCase,
+		r.SmartCase, r.Word, scope, r.Paths)
+}
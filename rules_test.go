@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestRuleAppliesTo(t *testing.T) {
+	cases := []struct {
+		scope string
+		paths []string
+		path  string
+		in    string
+		want  bool
+	}{
+		{"", nil, "foo.go", ScopeContent, true},
+		{"", nil, "foo.go", ScopeNames, true},
+		{ScopeBoth, nil, "foo.go", ScopeNames, true},
+		{ScopeContent, nil, "foo.go", ScopeContent, true},
+		{ScopeContent, nil, "foo.go", ScopeNames, false},
+		{ScopeNames, nil, "foo.go", ScopeContent, false},
+		{"", []string{"*.go"}, "sub/foo.go", ScopeContent, true},
+		{"", []string{"*.go"}, "sub/foo.py", ScopeContent, false},
+		{"", []string{"*.go", "!vendor/"}, "vendor/foo.go", ScopeContent, false},
+	}
+	for index, c := range cases {
+		rule := &Rule{Search: "foo", Scope: c.scope, Paths: c.paths}
+		if err := rule.compile(); err != nil {
+			t.Fatal(err)
+		}
+		got := rule.appliesTo(c.path, c.in)
+		if got != c.want {
+			t.Errorf(
+				"Case: #%d - scope: %s, paths: %v, appliesTo(%s, %s) == %v, want %v",
+				index, c.scope, c.paths, c.path, c.in, got, c.want)
+		}
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules("testdata/t5.rules.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[2].Search != "FOO_(CLIENT)" || !rules[2].Regexp {
+		t.Errorf("Unexpected rules: %v", rules)
+	}
+}
@@ -0,0 +1,4 @@
+package client
+
+// BarClient talks to foo_client via BAR_CLIENT_URL.
+type BarClient struct{}
@@ -0,0 +1,2 @@
+BAR_CLIENT_URL = "http://localhost"
+bar_client = BarClient()
@@ -0,0 +1,4 @@
+package client
+
+// FooClient talks to foo_client via FOO_CLIENT_URL.
+type FooClient struct{}
@@ -0,0 +1,2 @@
+FOO_CLIENT_URL = "http://localhost"
+foo_client = FooClient()
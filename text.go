@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	LineBreakLF   = "\n"
+	LineBreakCRLF = "\r\n"
+)
+
+// Encodings of the --encoding option, auto detects the encoding of every
+// file.
+const (
+	EncodingAuto    = "auto"
+	EncodingUTF8    = "utf-8"
+	EncodingLatin1  = "latin1"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingUTF32LE = "utf-32le"
+	EncodingUTF32BE = "utf-32be"
+)
+
+var encodings = []string{
+	EncodingAuto, EncodingUTF8, EncodingLatin1,
+	EncodingUTF16LE, EncodingUTF16BE, EncodingUTF32LE, EncodingUTF32BE,
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// boms are the byte order marks of the encodings, UTF-32LE comes before
+// UTF-16LE, because its BOM starts with the one of UTF-16LE.
+var boms = []struct {
+	encoding string
+	bom      []byte
+}{
+	{EncodingUTF8, utf8BOM},
+	{EncodingUTF32LE, []byte{0xFF, 0xFE, 0x00, 0x00}},
+	{EncodingUTF32BE, []byte{0x00, 0x00, 0xFE, 0xFF}},
+	{EncodingUTF16LE, []byte{0xFF, 0xFE}},
+	{EncodingUTF16BE, []byte{0xFE, 0xFF}},
+}
+
+// TextFormat describes the conventions of a text file, they are detected when
+// the file is read and restored when it is written.
+type TextFormat struct {
+	Encoding string
+	BOM      bool
+	// LineBreak is empty if the file has no or mixed line breaks, which
+	// are kept as they are
+	LineBreak string
+}
+
+func isEncoding(name string) bool {
+	for _, encoding := range encodings {
+		if name == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// isWideEncoding reports whether the encoding uses more than one byte for
+// every character, so its line feeds are not a single LF byte.
+func isWideEncoding(encoding string) bool {
+	switch encoding {
+	case EncodingUTF16LE, EncodingUTF16BE, EncodingUTF32LE, EncodingUTF32BE:
+		return true
+	}
+	return false
+}
+
+// textEncoding returns the encoding of the content for the encoding given by
+// --encoding, it is empty if the content looks binary.
+func textEncoding(content []byte, encoding string) string {
+	switch encoding {
+	case EncodingAuto:
+		return detectEncoding(content)
+	case EncodingUTF8:
+		if isBinary(content) {
+			return ""
+		}
+	case EncodingLatin1:
+		if hasControlCharacters(checkBlock(content)) {
+			return ""
+		}
+	default:
+		if !isWideText(content, encoding) {
+			return ""
+		}
+	}
+	return encoding
+}
+
+// detectEncoding detects the encoding by the BOM, without BOM valid UTF-8 is
+// UTF-8, ASCII text with every other byte NUL is UTF-16 and text without
+// control characters is Latin-1. It is empty if the content looks binary.
+func detectEncoding(content []byte) string {
+	for _, b := range boms {
+		// the UTF-8 BOM is detected as UTF-8 below, if the content is
+		// valid UTF-8
+		if b.encoding != EncodingUTF8 && bytes.HasPrefix(content, b.bom) {
+			return b.encoding
+		}
+	}
+	if !isBinary(content) {
+		return EncodingUTF8
+	}
+	block := checkBlock(content)
+	if len(content)%2 == 0 {
+		if encoding := guessUTF16(block); encoding != "" && isWideText(content, encoding) {
+			return encoding
+		}
+	}
+	if !hasControlCharacters(block) {
+		return EncodingLatin1
+	}
+	return ""
+}
+
+// guessUTF16 detects UTF-16 without BOM by the NUL bytes of ASCII
+// characters, which are the odd bytes in little endian and the even bytes in
+// big endian.
+func guessUTF16(block []byte) string {
+	even, odd := 0, 0
+	for i := 0; i+1 < len(block); i += 2 {
+		if block[i] == 0 {
+			even++
+		}
+		if block[i+1] == 0 {
+			odd++
+		}
+	}
+	units := len(block) / 2
+	switch {
+	case odd > units/2 && even*10 < odd:
+		return EncodingUTF16LE
+	case even > units/2 && odd*10 < even:
+		return EncodingUTF16BE
+	}
+	return ""
+}
+
+// isWideText reports whether the content looks like text in UTF-16 or
+// UTF-32: its length is a multiple of the code unit and its first block
+// decodes to printable text. Most bytes decode to some character in UTF-16,
+// but binary content has control characters, unpaired surrogates or
+// unassigned and private characters.
+func isWideText(content []byte, encoding string) bool {
+	size := 2
+	if encoding == EncodingUTF32LE || encoding == EncodingUTF32BE {
+		size = 4
+	}
+	if len(content)%size != 0 {
+		return false
+	}
+	content = bytes.TrimPrefix(content, byteOrderMark(encoding))
+	block := checkBlock(content)
+	block = block[:len(block)-len(block)%size]
+	text, err := decode(block, encoding)
+	if err != nil && size == 2 && len(block) < len(content) {
+		// the block may end in the middle of a surrogate pair
+		text, err = decode(block[:len(block)-size], encoding)
+	}
+	return err == nil && isPrintable(text)
+}
+
+// isPrintable reports whether the text contains only graphic characters,
+// format characters (like the zero width joiner) and white space, which is
+// found in text files.
+func isPrintable(text string) bool {
+	for _, r := range text {
+		switch {
+		case r == '\t', r == '\n', r == '\r', r == '\f':
+		case unicode.IsGraphic(r), unicode.Is(unicode.Cf, r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decodeText decodes the content and returns the text without BOM and with
+// LF line breaks, it fails if the content is not valid in the encoding.
+// Binary content (encoding "") is taken as it is. CRLF line breaks are only
+// converted, if they are restored without loss: a CR in front of a CRLF
+// would be lost.
+func decodeText(content []byte, encoding string) (string, TextFormat, error) {
+	format := TextFormat{Encoding: encoding}
+	if bom := byteOrderMark(encoding); bom != nil && bytes.HasPrefix(content, bom) {
+		format.BOM = true
+		content = content[len(bom):]
+	}
+	text, err := decode(content, encoding)
+	if err != nil || encoding == "" {
+		return text, format, err
+	}
+
+	lf := strings.Count(text, "\n")
+	crlf := strings.Count(text, "\r\n")
+	switch {
+	case crlf > 0 && crlf == lf && !strings.Contains(text, "\r\r\n"):
+		format.LineBreak = LineBreakCRLF
+		text = strings.Replace(text, "\r\n", "\n", -1)
+	case lf > 0 && crlf == 0:
+		format.LineBreak = LineBreakLF
+	}
+	return text, format, nil
+}
+
+// encode converts the text back to the format, line breaks added by a
+// replacement are converted too. It fails if the text contains characters,
+// which can not be encoded.
+func (f TextFormat) encode(text string) ([]byte, error) {
+	switch f.LineBreak {
+	case LineBreakCRLF:
+		text = strings.Replace(text, "\r\n", "\n", -1)
+		text = strings.Replace(text, "\n", "\r\n", -1)
+	case LineBreakLF:
+		text = strings.Replace(text, "\r\n", "\n", -1)
+	}
+	var result []byte
+	if f.BOM {
+		result = append(result, byteOrderMark(f.Encoding)...)
+	}
+	return encode(result, text, f.Encoding)
+}
+
+// encodedLength returns the number of bytes of the text in the format.
+func (f TextFormat) encodedLength(text string) int {
+	length := len(text)
+	switch f.Encoding {
+	case EncodingLatin1:
+		length = utf8.RuneCountInString(text)
+	case EncodingUTF16LE, EncodingUTF16BE:
+		length = 0
+		for _, r := range text {
+			length += 2 * len(utf16.Encode([]rune{r}))
+		}
+	case EncodingUTF32LE, EncodingUTF32BE:
+		length = 4 * utf8.RuneCountInString(text)
+	}
+	if f.LineBreak == LineBreakCRLF {
+		length += strings.Count(text, "\n") * TextFormat{Encoding: f.Encoding}.encodedLength("\r")
+	}
+	return length
+}
+
+// fileOffset maps byte offsets of a decoded text to byte offsets in its
+// file, the offsets have to be mapped in increasing order.
+type fileOffset struct {
+	format     TextFormat
+	text       string
+	offset     int
+	fileOffset int
+}
+
+func newFileOffset(text string, format TextFormat) *fileOffset {
+	f := &fileOffset{format: format, text: text}
+	if format.BOM {
+		f.fileOffset = len(byteOrderMark(format.Encoding))
+	}
+	return f
+}
+
+func (f *fileOffset) at(offset int) int {
+	f.fileOffset += f.format.encodedLength(f.text[f.offset:offset])
+	f.offset = offset
+	return f.fileOffset
+}
+
+// fileLocation converts the column and the match index of matches in a
+// decoded text to bytes of its file, the matches have to be located in the
+// order of the text.
+type fileLocation struct {
+	lineStart, start, end *fileOffset
+}
+
+func newFileLocation(text string, format TextFormat) *fileLocation {
+	return &fileLocation{
+		lineStart: newFileOffset(text, format),
+		start:     newFileOffset(text, format),
+		end:       newFileOffset(text, format),
+	}
+}
+
+func (l *fileLocation) locate(info *ReplacementInfo) {
+	start, end := info.MatchIndex[0], info.MatchIndex[1]
+	lineStart := l.lineStart.at(start - info.Column + 1)
+	info.MatchIndex = []int{l.start.at(start), l.end.at(end)}
+	info.Column = info.MatchIndex[0] - lineStart + 1
+}
+
+func byteOrderMark(encoding string) []byte {
+	for _, b := range boms {
+		if b.encoding == encoding {
+			return b.bom
+		}
+	}
+	return nil
+}
+
+func byteOrder(encoding string) binary.ByteOrder {
+	if encoding == EncodingUTF16BE || encoding == EncodingUTF32BE {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// decode converts the content to UTF-8, UTF-8 is taken as it is, so binary
+// files are not changed by decoding.
+func decode(content []byte, encoding string) (string, error) {
+	order := byteOrder(encoding)
+	var text strings.Builder
+	switch encoding {
+	case EncodingLatin1:
+		text.Grow(len(content))
+		for _, c := range content {
+			text.WriteRune(rune(c))
+		}
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if len(content)%2 != 0 {
+			return "", fmt.Errorf("invalid %s, odd number of bytes", encoding)
+		}
+		text.Grow(len(content) / 2)
+		for i := 0; i < len(content); i += 2 {
+			r := rune(order.Uint16(content[i:]))
+			if utf16.IsSurrogate(r) {
+				// a surrogate pair, an unpaired surrogate can not be
+				// encoded again
+				if i+4 > len(content) {
+					return "", fmt.Errorf("invalid %s at byte %d", encoding, i)
+				}
+				r = utf16.DecodeRune(r, rune(order.Uint16(content[i+2:])))
+				if r == utf8.RuneError {
+					return "", fmt.Errorf("invalid %s at byte %d", encoding, i)
+				}
+				i += 2
+			}
+			text.WriteRune(r)
+		}
+	case EncodingUTF32LE, EncodingUTF32BE:
+		if len(content)%4 != 0 {
+			return "", fmt.Errorf("invalid %s, number of bytes is not a multiple of 4", encoding)
+		}
+		text.Grow(len(content) / 4)
+		for i := 0; i < len(content); i += 4 {
+			r := rune(order.Uint32(content[i:]))
+			if !utf8.ValidRune(r) {
+				return "", fmt.Errorf("invalid %s at byte %d", encoding, i)
+			}
+			text.WriteRune(r)
+		}
+	default:
+		return string(content), nil
+	}
+	return text.String(), nil
+}
+
+// encode appends the text in the encoding to result, binary content
+// (encoding "") is appended as it is.
+func encode(result []byte, text, encoding string) ([]byte, error) {
+	if encoding == EncodingUTF8 || encoding == "" {
+		return append(result, text...), nil
+	}
+	order := byteOrder(encoding)
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if r == utf8.RuneError && size == 1 {
+			return nil, fmt.Errorf("invalid UTF-8 at byte %d", i)
+		}
+		switch encoding {
+		case EncodingLatin1:
+			if r > 0xFF {
+				return nil, fmt.Errorf("%q is not a %s character", r, encoding)
+			}
+			result = append(result, byte(r))
+		case EncodingUTF16LE, EncodingUTF16BE:
+			var unit [2]byte
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				order.PutUint16(unit[:], uint16(r1))
+				result = append(result, unit[:]...)
+				r = r2
+			}
+			order.PutUint16(unit[:], uint16(r))
+			result = append(result, unit[:]...)
+		case EncodingUTF32LE, EncodingUTF32BE:
+			var unit [4]byte
+			order.PutUint32(unit[:], uint32(r))
+			result = append(result, unit[:]...)
+		}
+		i += size
+	}
+	return result, nil
+}
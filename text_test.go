@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestTextFormat(t *testing.T) {
+	cases := []struct {
+		content  string
+		text     string
+		format   TextFormat
+		replaced string
+		expected string
+	}{
+		{"a\nb\n", "a\nb\n", TextFormat{Encoding: EncodingUTF8, LineBreak: LineBreakLF}, "a\r\nc\n", "a\nc\n"},
+		{"a\r\nb\r\n", "a\nb\n", TextFormat{Encoding: EncodingUTF8, LineBreak: LineBreakCRLF}, "a\nc\r\nd\n", "a\r\nc\r\nd\r\n"},
+		{"a\r\nb\n", "a\r\nb\n", TextFormat{Encoding: EncodingUTF8}, "a\r\nc\n", "a\r\nc\n"},
+		{"a\r\r\nfoo\r\nb\r\n", "a\r\r\nfoo\r\nb\r\n", TextFormat{Encoding: EncodingUTF8}, "a\r\r\nbaz\r\nb\r\n", "a\r\r\nbaz\r\nb\r\n"},
+		{"ab", "ab", TextFormat{Encoding: EncodingUTF8}, "a\nb", "a\nb"},
+		{"\xEF\xBB\xBFa\r\n", "a\n", TextFormat{Encoding: EncodingUTF8, BOM: true, LineBreak: LineBreakCRLF}, "b\n", "\xEF\xBB\xBFb\r\n"},
+		{"caf\xe9\n", "café\n", TextFormat{Encoding: EncodingLatin1, LineBreak: LineBreakLF}, "thé\n", "th\xe9\n"},
+		{"\xFF\xFEa\x00\r\x00\n\x00", "a\n", TextFormat{Encoding: EncodingUTF16LE, BOM: true, LineBreak: LineBreakCRLF}, "é\n", "\xFF\xFE\xE9\x00\r\x00\n\x00"},
+		{"\xFE\xFF\xD8\x3D\xDE\x00", "😀", TextFormat{Encoding: EncodingUTF16BE, BOM: true}, "a😀", "\xFE\xFF\x00a\xD8\x3D\xDE\x00"},
+		{"a\x00b\x00\n\x00", "ab\n", TextFormat{Encoding: EncodingUTF16LE, LineBreak: LineBreakLF}, "c\n", "c\x00\n\x00"},
+		{"\x00a\x00b", "ab", TextFormat{Encoding: EncodingUTF16BE}, "c", "\x00c"},
+		{"\xFF\xFE\x00\x00a\x00\x00\x00", "a", TextFormat{Encoding: EncodingUTF32LE, BOM: true}, "é", "\xFF\xFE\x00\x00\xE9\x00\x00\x00"},
+		{"\x00\x00\xFE\xFF\x00\x00\x00a", "a", TextFormat{Encoding: EncodingUTF32BE, BOM: true}, "b", "\x00\x00\xFE\xFF\x00\x00\x00b"},
+		{"a\x00\r\nb\x00\r\n", "a\x00\r\nb\x00\r\n", TextFormat{}, "c\x00\nb\x00\r\n", "c\x00\nb\x00\r\n"},
+		{"\xEF\xBB\xBF\x00\r\n", "\xEF\xBB\xBF\x00\r\n", TextFormat{}, "\xEF\xBB\xBF\x00\n", "\xEF\xBB\xBF\x00\n"},
+	}
+	for index, c := range cases {
+		text, format, err := decodeText([]byte(c.content), textEncoding([]byte(c.content), EncodingAuto))
+		if err != nil || text != c.text || format != c.format {
+			t.Errorf(
+				"Case: #%d - expected: %q %+v, actual: %q %+v (%v)",
+				index, c.text, c.format, text, format, err)
+		}
+		if encoded, _ := format.encode(text); string(encoded) != c.content {
+			t.Errorf("Case: #%d - round trip: %q", index, encoded)
+		}
+		if encoded, _ := format.encode(c.replaced); string(encoded) != c.expected {
+			t.Errorf("Case: #%d - expected: %q, actual: %q", index, c.expected, encoded)
+		}
+	}
+}
+
+func TestTextEncoding(t *testing.T) {
+	cases := []struct {
+		content  string
+		encoding string
+		expected string
+	}{
+		{"foo", EncodingAuto, EncodingUTF8},
+		{"\xEF\xBB\xBFfoo", EncodingAuto, EncodingUTF8},
+		{"caf\xe9", EncodingAuto, EncodingLatin1},
+		{"\x89PNG\r\n\x1a\n", EncodingAuto, ""},
+		{"foo\x00bar", EncodingAuto, ""},
+		{"f\x00o\x00o\x00", EncodingAuto, EncodingUTF16LE},
+		{"\x00f\x00o\x00o", EncodingAuto, EncodingUTF16BE},
+		{"f\x00o\x00o", EncodingAuto, ""},
+		{"foo\x00bar", EncodingUTF8, ""},
+		{"caf\xe9", EncodingUTF8, ""},
+		{"caf\xe9", EncodingLatin1, EncodingLatin1},
+		{"foo\x00bar", EncodingLatin1, ""},
+		{"f\x00o\x00o\x00", EncodingUTF16LE, EncodingUTF16LE},
+		{"\xFF\xFEf\x00o\x00", EncodingUTF16LE, EncodingUTF16LE},
+		{"\x00f\x00\n", EncodingUTF16BE, EncodingUTF16BE},
+		{"f\x00o\x00o", EncodingUTF16LE, ""},
+		{"\x01\x00\x02\x00", EncodingUTF16LE, ""},
+		{"\x00\xD8\x00\x00", EncodingUTF16LE, ""},
+		{"\x00\xE0\x01\xE0", EncodingUTF16LE, ""},
+		{"f\x00\x00\x00o\x00\x00\x00", EncodingUTF32LE, EncodingUTF32LE},
+		{"\x89PNG\r\n\x1a\n", EncodingUTF32BE, ""},
+	}
+	for index, c := range cases {
+		if encoding := textEncoding([]byte(c.content), c.encoding); encoding != c.expected {
+			t.Errorf("Case: #%d - expected: %q, actual: %q", index, c.expected, encoding)
+		}
+	}
+}
+
+func TestTextEncodingErrors(t *testing.T) {
+	cases := []struct {
+		content  string
+		encoding string
+		replaced string
+		expected string
+	}{
+		{"a\x00b", EncodingUTF16LE, "", "invalid utf-16le, odd number of bytes"},
+		{"\x00\xD8a\x00", EncodingUTF16LE, "", "invalid utf-16le at byte 0"},
+		{"a\x00\x00\xD8", EncodingUTF16LE, "", "invalid utf-16le at byte 2"},
+		{"\x00\x00\x11\x00", EncodingUTF32LE, "", "invalid utf-32le at byte 0"},
+		{"a\x00\x00", EncodingUTF32LE, "", "invalid utf-32le, number of bytes is not a multiple of 4"},
+		{"caf\xe9", EncodingLatin1, "€", "'€' is not a latin1 character"},
+		{"a\x00", EncodingUTF16LE, "\xff", "invalid UTF-8 at byte 0"},
+	}
+	for index, c := range cases {
+		_, format, err := decodeText([]byte(c.content), c.encoding)
+		if err == nil {
+			_, err = format.encode(c.replaced)
+		}
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("Case: #%d - expected: %q, actual: %v", index, c.expected, err)
+		}
+	}
+}
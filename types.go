@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fileTypes are the presets for the --type option.
+var fileTypes = map[string][]string{
+	"c":      {"*.c", "*.h"},
+	"cpp":    {"*.cpp", "*.cc", "*.cxx", "*.hpp", "*.hh", "*.hxx", "*.h"},
+	"cs":     {"*.cs"},
+	"css":    {"*.css", "*.scss", "*.sass", "*.less"},
+	"go":     {"*.go"},
+	"html":   {"*.html", "*.htm"},
+	"java":   {"*.java"},
+	"js":     {"*.js", "*.jsx", "*.mjs", "*.cjs"},
+	"json":   {"*.json"},
+	"kotlin": {"*.kt", "*.kts"},
+	"md":     {"*.md", "*.markdown"},
+	"php":    {"*.php"},
+	"py":     {"*.py", "*.pyi"},
+	"rb":     {"*.rb"},
+	"rust":   {"*.rs"},
+	"sh":     {"*.sh", "*.bash", "*.zsh"},
+	"sql":    {"*.sql"},
+	"swift":  {"*.swift"},
+	"ts":     {"*.ts", "*.tsx"},
+	"xml":    {"*.xml"},
+	"yaml":   {"*.yaml", "*.yml"},
+}
+
+// typePatterns returns the glob patterns of the given file types.
+func typePatterns(types []string) ([]string, error) {
+	patterns := []string{}
+	for _, t := range types {
+		typePatterns, ok := fileTypes[t]
+		if !ok {
+			return nil, fmt.Errorf("Unknown file type: %s (see --type-list)", t)
+		}
+		patterns = append(patterns, typePatterns...)
+	}
+	return patterns, nil
+}
+
+func typeList() string {
+	names := []string{}
+	for name := range fileTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := ""
+	for _, name := range names {
+		list += fmt.Sprintf("%s: %s\n", name, strings.Join(fileTypes[name], ", "))
+	}
+	return list
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type undoOptions struct {
+	Force   bool `short:"f" long:"force"   description:"Undo even if files were changed since the run"`
+	DryRun  bool `short:"d" long:"dry-run" description:"Do not change anything"`
+	Verbose bool `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Args    struct {
+		RunID string `positional-arg-name:"run-id" description:"Run to undo (default: latest)"`
+	} `positional-args:"yes"`
+}
+
+// undoSub restores the tree to the state before a run with the help of its
+// journal.
+func undoSub(workingDir string, output *Output, stdin io.Reader, args []string) int {
+	opts := &undoOptions{}
+	if exitCode, ok := parseCommandOptions(output, "undo", opts, args); !ok {
+		return exitCode
+	}
+	output.verbose = opts.Verbose
+
+	journal, err := LoadJournal(workingDir, opts.Args.RunID)
+	if err != nil {
+		output.reportError("Could not load journal: %s", err)
+		return ExitError
+	}
+	if journal.Undone {
+		output.reportError("Run %s was already undone", journal.ID)
+		return ExitError
+	}
+	output.reportVerbose("Run: %s %v", journal.ID, journal.Args)
+
+	conflicts := journal.conflicts()
+	for _, conflict := range conflicts {
+		if opts.Force {
+			output.reportWarning("%s", conflict)
+		} else {
+			output.reportError("%s", conflict)
+		}
+	}
+	if len(conflicts) > 0 && !opts.Force {
+		output.reportError("Files were changed since run %s, nothing undone (use --force)", journal.ID)
+		return ExitError
+	}
+
+	writer := &FileWriter{HardLinks: HardLinksInPlace}
+	failed := false
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		entry := journal.Entries[i]
+		switch entry.Type {
+		case JournalRename:
+			output.reportInfo("Rename: %s to %s", entry.NewPath, entry.Path)
+			if opts.DryRun {
+				continue
+			}
+			err := os.Rename(journal.absolutePath(entry.NewPath), journal.absolutePath(entry.Path))
+			if err != nil {
+				output.reportError("Could not move: %s (%s)", entry.NewPath, err)
+				failed = true
+			}
+		case JournalRemove:
+			output.reportInfo("Create: %s", entry.Path)
+			if opts.DryRun {
+				continue
+			}
+			if err := createDirectory(journal.absolutePath(entry.Path), entry.Mode); err != nil {
+				output.reportError("Could not create: %s (%s)", entry.Path, err)
+				failed = true
+			}
+		case JournalWrite:
+			output.reportInfo("Restore: %s", entry.Path)
+			if opts.DryRun {
+				continue
+			}
+			if err := restoreBackup(journal, entry, writer); err != nil {
+				output.reportError("Could not restore: %s (%s)", entry.Path, err)
+				failed = true
+			}
+		}
+	}
+	if opts.DryRun {
+		return ExitOK
+	}
+	if failed {
+		output.reportError("Run %s was only partially undone", journal.ID)
+		return ExitError
+	}
+
+	journal.Undone = true
+	if err := journal.save(); err != nil {
+		output.reportError("Could not write journal: %s", err)
+		return ExitError
+	}
+	os.RemoveAll(journal.backupPath(""))
+	output.reportInfo("Undone run: %s", journal.ID)
+
+	return ExitOK
+}
+
+// createDirectory creates a directory with the mode, which is not restricted
+// by the umask.
+func createDirectory(path string, mode os.FileMode) error {
+	if err := os.Mkdir(path, mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+func restoreBackup(journal *Journal, entry *JournalEntry, writer *FileWriter) error {
+	content, err := ioutil.ReadFile(journal.backupPath(entry.Backup))
+	if err != nil {
+		return err
+	}
+	path := journal.absolutePath(entry.Path)
+	if entry.Pending {
+		// the file was not written, if it still has its original content
+		if current, err := ioutil.ReadFile(path); err == nil && contentHash(current) == entry.OriginalHash {
+			return nil
+		}
+	}
+	fileInfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ioutil.WriteFile(path, content, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Write(path, content, fileInfo)
+}
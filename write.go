@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	HardLinksSkip    = "skip"
+	HardLinksInPlace = "in-place"
+)
+
+var ErrHardLinked = errors.New("file has multiple hard links")
+
+// FileWriter replaces the content of files. The content is written to a
+// temporary file in the same directory, which is synced and then renamed
+// over the original, so a crash never leaves a truncated file behind.
+type FileWriter struct {
+	// PreserveMtime keeps the modification time of the original file
+	PreserveMtime bool
+	// HardLinks decides how files with multiple hard links are written,
+	// renaming over them would break the link: HardLinksSkip (default)
+	// returns ErrHardLinked, HardLinksInPlace overwrites the file in place
+	HardLinks string
+}
+
+func (w *FileWriter) Write(path string, data []byte, fileInfo os.FileInfo) error {
+	// respect the permissions of the original file, although only the
+	// permissions of the directory are relevant for the rename
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	if linkCount(fileInfo) > 1 {
+		if w.HardLinks != HardLinksInPlace {
+			return ErrHardLinked
+		}
+		return w.writeInPlace(path, data, fileInfo)
+	}
+	return w.writeAtomic(path, data, fileInfo)
+}
+
+func (w *FileWriter) writeAtomic(path string, data []byte, fileInfo os.FileInfo) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), fileInfo.Mode()); err != nil {
+		return err
+	}
+	if err = chownLike(tmp.Name(), fileInfo); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if w.PreserveMtime {
+		if err = os.Chtimes(tmp.Name(), time.Now(), fileInfo.ModTime()); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename, not supported on every platform
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (w *FileWriter) writeInPlace(path string, data []byte, fileInfo os.FileInfo) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if w.PreserveMtime {
+		return os.Chtimes(path, time.Now(), fileInfo.ModTime())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.txt")
+	ioutil.WriteFile(path, []byte("foo"), 0640)
+	mtime := time.Date(2015, 11, 15, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(path, mtime, mtime)
+	fileInfo, _ := os.Stat(path)
+
+	writer := &FileWriter{PreserveMtime: true}
+	if err := writer.Write(path, []byte("bar"), fileInfo); err != nil {
+		t.Fatal(err)
+	}
+
+	newFileInfo, _ := os.Stat(path)
+	if content, _ := ioutil.ReadFile(path); string(content) != "bar" {
+		t.Errorf("content: %s, expected: bar", content)
+	}
+	if newFileInfo.Mode() != 0640 {
+		t.Errorf("mode: %v, expected: %v", newFileInfo.Mode(), os.FileMode(0640))
+	}
+	if !newFileInfo.ModTime().Equal(mtime) {
+		t.Errorf("mtime: %v, expected: %v", newFileInfo.ModTime(), mtime)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary file was not removed: %v", entries)
+	}
+}
+
+func TestFileWriterHardLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search-and-replace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo.txt")
+	link := filepath.Join(dir, "link.txt")
+	ioutil.WriteFile(path, []byte("foo"), 0644)
+	if err := os.Link(path, link); err != nil {
+		t.Skip("hard links are not supported:", err)
+	}
+	fileInfo, _ := os.Stat(path)
+
+	err = (&FileWriter{HardLinks: HardLinksSkip}).Write(path, []byte("bar"), fileInfo)
+	if err != ErrHardLinked {
+		t.Errorf("err: %v, expected: %v", err, ErrHardLinked)
+	}
+
+	err = (&FileWriter{HardLinks: HardLinksInPlace}).Write(path, []byte("bar"), fileInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(link); string(content) != "bar" {
+		t.Errorf("content of link: %s, expected: bar", content)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func linkCount(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 1
+}
+
+// chownLike gives path the owner and group of fileInfo.
+func chownLike(path string, fileInfo os.FileInfo) error {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return os.Chown(path, int(stat.Uid), int(stat.Gid))
+	}
+	return nil
+}
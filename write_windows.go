@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+func linkCount(fileInfo os.FileInfo) uint64 {
+	return 1
+}
+
+func chownLike(path string, fileInfo os.FileInfo) error {
+	return nil
+}